@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MAX_STDERR_LENGTH is the maximum number of characters of the error output of a
+// command kept in the diagnostics attributes.
+const MAX_STDERR_LENGTH = 512
+
+// commandRun holds the details of the last run of a sensor command.
+//
+// Fields:
+// - stderr: The error output of the command.
+// - exitCode: The exit code of the command, or -1 if it could not be started.
+// - duration: The time taken by the command.
+// - fields: The extra fields of the output when the value is read from a JSON object.
+type commandRun struct {
+	stderr   string
+	exitCode int
+	duration time.Duration
+	fields   map[string]any
+}
+
+// attributesSource builds the attributes of a sensor from the configured sources.
+//
+// Fields:
+// - command: The command whose output provides attributes.
+// - jsonFields: Whether the extra fields of the sensor output are attributes.
+// - diagnostics: Whether the details of the sensor command run are attributes.
+type attributesSource struct {
+	command     string
+	jsonFields  bool
+	diagnostics bool
+}
+
+// newAttributesSource creates the attributes source of a sensor from its configuration.
+func newAttributesSource(cfg AttributesConfig, valueField string) (*attributesSource, error) {
+	source := &attributesSource{
+		command:     cfg.Command,
+		jsonFields:  valueField != "",
+		diagnostics: cfg.Diagnostics,
+	}
+	if source.command == "" && !source.diagnostics && !source.jsonFields {
+		return nil, fmt.Errorf("attributes need a command, diagnostics or a value_field")
+	}
+	return source, nil
+}
+
+// collect returns the attributes of the sensor for the given command run.
+// Errors of the attributes command are reported as an attribute so that they
+// never prevent the value of the sensor from being published.
+func (a *attributesSource) collect(ctx context.Context, run commandRun) map[string]any {
+	attributes := map[string]any{}
+
+	if a.jsonFields {
+		for key, value := range run.fields {
+			attributes[key] = value
+		}
+	}
+
+	if a.command != "" {
+		output, err := shellCommand(ctx, a.command).Output()
+		if err == nil {
+			var commandAttributes map[string]any
+			commandAttributes, err = parseAttributes(string(output))
+			for key, value := range commandAttributes {
+				attributes[key] = value
+			}
+		}
+		if err != nil {
+			attributes["attributes_error"] = err.Error()
+		}
+	}
+
+	if a.diagnostics {
+		stderr := strings.TrimSpace(run.stderr)
+		if len(stderr) > MAX_STDERR_LENGTH {
+			stderr = stderr[:MAX_STDERR_LENGTH]
+		}
+		attributes["exit_code"] = run.exitCode
+		attributes["stderr"] = stderr
+		attributes["duration_ms"] = run.duration.Milliseconds()
+	}
+
+	return attributes
+}
+
+// parseAttributes parses the output of an attributes command. The output is
+// either a JSON object, or lines of `key=value` or `key: value` pairs.
+func parseAttributes(output string) (map[string]any, error) {
+	output = strings.TrimSpace(output)
+	if strings.HasPrefix(output, "{") {
+		var attributes map[string]any
+		if err := json.Unmarshal([]byte(output), &attributes); err != nil {
+			return nil, fmt.Errorf("invalid JSON attributes: %w", err)
+		}
+		return attributes, nil
+	}
+
+	attributes := map[string]any{}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			key, value, found = strings.Cut(line, ":")
+		}
+		if !found {
+			return nil, fmt.Errorf("invalid attribute line %q", line)
+		}
+		attributes[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return attributes, nil
+}
+
+// splitValueField reads the value of a sensor from the given field of a JSON
+// object and returns the other fields of the object.
+func splitValueField(output string, field string) (string, map[string]any, error) {
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(output), &fields); err != nil {
+		return "", nil, fmt.Errorf("output is not a JSON object: %w", err)
+	}
+	value, ok := fields[field]
+	if !ok {
+		return "", nil, fmt.Errorf("output has no field %q", field)
+	}
+	delete(fields, field)
+
+	switch value := value.(type) {
+	case string:
+		return value, fields, nil
+	case float64:
+		return fmt.Sprint(value), fields, nil
+	case bool:
+		return fmt.Sprint(value), fields, nil
+	default:
+		return "", nil, fmt.Errorf("field %q is not a plain value", field)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/iancoleman/strcase"
+)
+
+const (
+	DISCOVERY_HWMON   = "hwmon"
+	DISCOVERY_THERMAL = "thermal"
+	DISCOVERY_BLOCK   = "block"
+	DISCOVERY_MOUNTS  = "mounts"
+	DISCOVERY_NET     = "net"
+)
+
+// discoverySource represents a hardware source of the autodiscovery and its defaults.
+//
+// Fields:
+// - kind: The name of the source in the configuration file.
+// - name: The default template of the names of its sensors.
+// - exclude: The default glob patterns of the items to skip, usually virtual devices.
+type discoverySource struct {
+	kind    string
+	name    string
+	exclude []string
+}
+
+// discoverySources lists the hardware sources in the order their sensors are generated.
+var discoverySources = []discoverySource{
+	{kind: DISCOVERY_HWMON, name: "{{.Chip}} {{.Label}}"},
+	{kind: DISCOVERY_THERMAL, name: "Thermal {{.Type}}"},
+	{kind: DISCOVERY_BLOCK, name: "Disk {{.Device}}", exclude: []string{"loop*", "ram*", "zram*", "sr*", "fd*"}},
+	{kind: DISCOVERY_MOUNTS, name: "Disk Usage {{.Mountpoint}}"},
+	{kind: DISCOVERY_NET, name: "Network {{.Interface}}", exclude: []string{"lo"}},
+}
+
+// discoveredItem represents a piece of hardware found by the autodiscovery.
+//
+// Fields:
+//   - key: The identifier matched against the include and exclude patterns.
+//   - data: The values available to the name template.
+//   - sensors: The sensors measuring the item. Their name is the suffix appended to the
+//     name generated by the template.
+type discoveredItem struct {
+	key     string
+	data    map[string]string
+	sensors []SensorConfig
+}
+
+// DiscoverSensors enumerates the hardware of the configured sources and generates
+// the configuration of their sensors. The generated sensors are created like the
+// sensors of the configuration file. Their names are numbered when their key is
+// already taken, by another generated sensor or by a configured one.
+//
+// Parameters:
+//   - cfg: The autodiscover section of the configuration file.
+//   - configured: The sensors of the configuration file, whose keys are taken.
+//
+// Returns:
+//   - The configurations of the generated sensors.
+//   - An error if a template or a pattern is invalid, or a source cannot be enumerated.
+func DiscoverSensors(cfg AutodiscoverConfig, configured []SensorConfig) ([]SensorConfig, error) {
+	configs := map[string]*DiscoverySourceConfig{
+		DISCOVERY_HWMON:   cfg.Hwmon,
+		DISCOVERY_THERMAL: cfg.Thermal,
+		DISCOVERY_BLOCK:   cfg.Block,
+		DISCOVERY_MOUNTS:  cfg.Mounts,
+		DISCOVERY_NET:     cfg.Net,
+	}
+
+	var sensors []SensorConfig
+	taken := map[string]bool{}
+	for _, sensor := range configured {
+		if sensor.Generated {
+			taken[sensorKey(sensor.Name)] = true
+		} else {
+			taken[strcase.ToSnake(sensor.Name)] = true
+		}
+	}
+	for _, source := range discoverySources {
+		sourceConfig := configs[source.kind]
+		if sourceConfig == nil {
+			continue
+		}
+		generated, err := discoverSource(source, *sourceConfig)
+		if err != nil {
+			return nil, fmt.Errorf("autodiscover %s: %w", source.kind, err)
+		}
+		for _, sensor := range generated {
+			// Several items may share a key, e.g. identical chips
+			name := sensor.Name
+			for count := 2; taken[sensorKey(sensor.Name)]; count++ {
+				sensor.Name = fmt.Sprintf("%s %d", name, count)
+			}
+			taken[sensorKey(sensor.Name)] = true
+			sensor.Discovered = true
+			sensors = append(sensors, sensor)
+		}
+	}
+	return sensors, nil
+}
+
+// SetAutodiscovery sets the hardware enumerated by ReloadDiscoveredSensors.
+//
+// Parameters:
+//   - cfg: The autodiscover section of the configuration file.
+//   - configured: The sensors of the configuration file, whose keys are taken.
+func (d *Device) SetAutodiscovery(cfg AutodiscoverConfig, configured []SensorConfig) {
+	d.autodiscover = &cfg
+	d.configured = configured
+}
+
+// ReloadDiscoveredSensors enumerates the hardware again and synchronizes the
+// discovered sensors of the device with it: the sensors of new hardware are created
+// and started, those of the hardware which is gone are stopped and removed. The
+// sensors still discovered are kept as they are. It does nothing without
+// autodiscovery.
+//
+// Returns:
+//   - The number of sensors added and removed.
+//   - An error if the hardware cannot be enumerated or a generated sensor is invalid,
+//     the sensors are then left untouched.
+func (d *Device) ReloadDiscoveredSensors() (int, int, error) {
+	if d.autodiscover == nil {
+		return 0, 0, nil
+	}
+	discovered, err := DiscoverSensors(*d.autodiscover, d.configured)
+	if err != nil {
+		return 0, 0, err
+	}
+	existing := map[string]*Sensor{}
+	for _, sensor := range d.sensors {
+		if sensor.config.Discovered {
+			existing[sensor.Key()] = sensor
+		}
+	}
+
+	kept := map[*Sensor]bool{}
+	var added []*Sensor
+	for _, sensorConfig := range discovered {
+		sensor, ok := existing[sensorKey(sensorConfig.Name)]
+		if !ok {
+			sensor, err = NewSensorFromConfig(sensorConfig, d)
+			if err != nil {
+				return 0, 0, err
+			}
+			added = append(added, sensor)
+		}
+		kept[sensor] = true
+		for _, linked := range sensor.GetLinkedSensors() {
+			kept[linked] = true
+		}
+	}
+
+	removed := 0
+	remaining := d.sensors[:0]
+	for _, sensor := range d.sensors {
+		if !sensor.config.Discovered || kept[sensor] {
+			remaining = append(remaining, sensor)
+			continue
+		}
+		if sensor.sampler != nil {
+			sensor.sampler.halt()
+		}
+		d.removed = append(d.removed, removedComponent{key: sensor.Key(), platform: sensor.config.Platform})
+		removed++
+	}
+	d.sensors = remaining
+	for _, sensor := range added {
+		d.AddSensor(sensor)
+		for _, linked := range sensor.GetLinkedSensors() {
+			d.AddSensor(linked)
+		}
+		if sensor.sampler != nil {
+			sensor.sampler.start()
+		}
+	}
+	if len(added) > 0 || removed > 0 {
+		d.changed()
+	}
+	return len(added), removed, nil
+}
+
+// discoverSource generates the sensors of the items of a source matching its patterns.
+func discoverSource(source discoverySource, cfg DiscoverySourceConfig) ([]SensorConfig, error) {
+	nameTemplate := cfg.Name
+	if nameTemplate == "" {
+		nameTemplate = source.name
+	}
+	tmpl, err := template.New(source.kind).Option("missingkey=error").Parse(nameTemplate)
+	if err != nil {
+		return nil, err
+	}
+	exclude := cfg.Exclude
+	if exclude == nil {
+		exclude = source.exclude
+	}
+	for _, pattern := range append(append([]string{}, cfg.Include...), exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	// A host without such hardware, e.g. a virtual machine without hwmon, has nothing to discover
+	items, err := discoverItems(source.kind)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	var sensors []SensorConfig
+	for _, item := range items {
+		if !matchesGlobs(item.key, cfg.Include, exclude) {
+			continue
+		}
+		var name bytes.Buffer
+		if err := tmpl.Execute(&name, item.data); err != nil {
+			return nil, err
+		}
+		for _, sensor := range item.sensors {
+			sensor.Name = strings.TrimSpace(name.String() + sensor.Name)
+			if cfg.Icon != "" {
+				sensor.Icon = cfg.Icon
+			}
+			sensor.MinChange = cfg.MinChange
+			sensor.MaxSilenceS = cfg.MaxSilenceS
+			sensors = append(sensors, sensor)
+		}
+	}
+	return sensors, nil
+}
+
+// matchesGlobs reports whether the key matches one of the include patterns, or
+// there are none, and none of the exclude patterns.
+func matchesGlobs(key string, include []string, exclude []string) bool {
+	matches := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, key); matched {
+				return true
+			}
+		}
+		return false
+	}
+	return (len(include) == 0 || matches(include)) && !matches(exclude)
+}
+
+// shellQuote quotes a path so that it can be used as a single word in a command.
+func shellQuote(text string) string {
+	return "'" + strings.ReplaceAll(text, "'", `'\''`) + "'"
+}
+
+// pointerTo returns a pointer to a copy of the value, for the optional settings.
+func pointerTo[T any](value T) *T {
+	return &value
+}
@@ -0,0 +1,266 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	SYSFS_ROOT  = "/sys"
+	PROC_MOUNTS = "/proc/mounts"
+)
+
+// hwmonInputPattern matches the input files of a hwmon chip, e.g. temp1_input.
+var hwmonInputPattern = regexp.MustCompile(`^(temp|fan|in|power)([0-9]+)_input$`)
+
+// mountEscapePattern matches the octal escapes of /proc/mounts, e.g. \040 for a space.
+var mountEscapePattern = regexp.MustCompile(`\\[0-7]{3}`)
+
+// discoverItems enumerates the items of a hardware source.
+func discoverItems(kind string) ([]discoveredItem, error) {
+	switch kind {
+	case DISCOVERY_HWMON:
+		return discoverHwmon()
+	case DISCOVERY_THERMAL:
+		return discoverThermal()
+	case DISCOVERY_BLOCK:
+		return discoverBlock()
+	case DISCOVERY_MOUNTS:
+		return discoverMounts()
+	case DISCOVERY_NET:
+		return discoverNet()
+	}
+	return nil, fmt.Errorf("unknown source %q", kind)
+}
+
+// discoverHwmon enumerates the inputs of the hwmon chips. Their key is the name of
+// the chip and the label of the input, e.g. "coretemp/Package id 0".
+func discoverHwmon() ([]discoveredItem, error) {
+	chips, err := os.ReadDir(filepath.Join(SYSFS_ROOT, "class", "hwmon"))
+	if err != nil {
+		return nil, err
+	}
+	var items []discoveredItem
+	for _, chip := range chips {
+		dir := filepath.Join(SYSFS_ROOT, "class", "hwmon", chip.Name())
+		chipName, err := readSysfsValue(filepath.Join(dir, "name"))
+		if err != nil {
+			continue
+		}
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			match := hwmonInputPattern.FindStringSubmatch(file.Name())
+			if match == nil {
+				continue
+			}
+			input := match[1] + match[2]
+			label, err := readSysfsValue(filepath.Join(dir, input+"_label"))
+			if err != nil || label == "" {
+				label = input
+			}
+			sensor := hwmonSensor(match[1])
+			sensor.Command = "cat " + shellQuote(filepath.Join(dir, file.Name()))
+			items = append(items, discoveredItem{
+				key: chipName + "/" + label,
+				data: map[string]string{
+					"Chip":  chipName,
+					"Label": label,
+					"Input": input,
+					"Hwmon": chip.Name(),
+				},
+				sensors: []SensorConfig{sensor},
+			})
+		}
+	}
+	return items, nil
+}
+
+// hwmonSensor returns the settings of a sensor reading a hwmon input of the given
+// type, whose values are in millidegrees, RPM, millivolts or microwatts.
+func hwmonSensor(inputType string) SensorConfig {
+	switch inputType {
+	case "temp":
+		return SensorConfig{
+			DeviceClass:       "temperature",
+			StateClass:        "measurement",
+			UnitOfMeasurement: "°C",
+			Transform:         []TransformStep{{Convert: "millicelsius_to_celsius"}},
+			Precision:         pointerTo(1),
+		}
+	case "fan":
+		return SensorConfig{
+			StateClass:        "measurement",
+			UnitOfMeasurement: "RPM",
+			Icon:              "mdi:fan",
+			Precision:         pointerTo(0),
+		}
+	case "in":
+		return SensorConfig{
+			DeviceClass:       "voltage",
+			StateClass:        "measurement",
+			UnitOfMeasurement: "V",
+			Transform:         []TransformStep{{Multiply: pointerTo(0.001)}},
+			Precision:         pointerTo(3),
+		}
+	}
+	return SensorConfig{
+		DeviceClass:       "power",
+		StateClass:        "measurement",
+		UnitOfMeasurement: "W",
+		Transform:         []TransformStep{{Multiply: pointerTo(0.000001)}},
+		Precision:         pointerTo(1),
+	}
+}
+
+// discoverThermal enumerates the thermal zones. Their key is their type, e.g. "x86_pkg_temp".
+func discoverThermal() ([]discoveredItem, error) {
+	zones, err := filepath.Glob(filepath.Join(SYSFS_ROOT, "class", "thermal", "thermal_zone*"))
+	if err != nil {
+		return nil, err
+	}
+	var items []discoveredItem
+	for _, zone := range zones {
+		zoneType, err := readSysfsValue(filepath.Join(zone, "type"))
+		if err != nil {
+			continue
+		}
+		sensor := hwmonSensor("temp")
+		sensor.Command = "cat " + shellQuote(filepath.Join(zone, "temp"))
+		items = append(items, discoveredItem{
+			key: zoneType,
+			data: map[string]string{
+				"Zone": filepath.Base(zone),
+				"Type": zoneType,
+			},
+			sensors: []SensorConfig{sensor},
+		})
+	}
+	return items, nil
+}
+
+// discoverBlock enumerates the disks. Their key is their name, e.g. "sda".
+func discoverBlock() ([]discoveredItem, error) {
+	disks, err := os.ReadDir(filepath.Join(SYSFS_ROOT, "block"))
+	if err != nil {
+		return nil, err
+	}
+	var items []discoveredItem
+	for _, disk := range disks {
+		stat := shellQuote(filepath.Join(SYSFS_ROOT, "block", disk.Name(), "stat"))
+		// The 3rd and 7th fields of the stat file count the sectors read and written,
+		// which are always 512 bytes long
+		items = append(items, discoveredItem{
+			key:  disk.Name(),
+			data: map[string]string{"Device": disk.Name()},
+			sensors: []SensorConfig{
+				throughputSensor(" Read", "awk '{print $3 * 512}' "+stat, "mdi:harddisk"),
+				throughputSensor(" Write", "awk '{print $7 * 512}' "+stat, "mdi:harddisk"),
+			},
+		})
+	}
+	return items, nil
+}
+
+// discoverMounts enumerates the filesystems mounted from a device. Their key is
+// their mount point, e.g. "/home".
+func discoverMounts() ([]discoveredItem, error) {
+	file, err := os.Open(PROC_MOUNTS)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var items []discoveredItem
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || !strings.HasPrefix(fields[0], "/dev/") {
+			continue
+		}
+		device, mountpoint, fsType := unescapeMountField(fields[0]), unescapeMountField(fields[1]), fields[2]
+		if seen[mountpoint] {
+			continue
+		}
+		seen[mountpoint] = true
+		items = append(items, discoveredItem{
+			key: mountpoint,
+			data: map[string]string{
+				"Mountpoint": mountpoint,
+				"Device":     device,
+				"FSType":     fsType,
+			},
+			sensors: []SensorConfig{{
+				Command:           "df -P " + shellQuote(mountpoint) + " | awk 'NR==2 {print $5}'",
+				StateClass:        "measurement",
+				UnitOfMeasurement: "%",
+				Icon:              "mdi:harddisk",
+				Transform:         []TransformStep{{StripSuffix: "%"}},
+			}},
+		})
+	}
+	return items, scanner.Err()
+}
+
+// discoverNet enumerates the network interfaces. Their key is their name, e.g. "eth0".
+func discoverNet() ([]discoveredItem, error) {
+	interfaces, err := os.ReadDir(filepath.Join(SYSFS_ROOT, "class", "net"))
+	if err != nil {
+		return nil, err
+	}
+	var items []discoveredItem
+	for _, iface := range interfaces {
+		statistics := filepath.Join(SYSFS_ROOT, "class", "net", iface.Name(), "statistics")
+		items = append(items, discoveredItem{
+			key:  iface.Name(),
+			data: map[string]string{"Interface": iface.Name()},
+			sensors: []SensorConfig{
+				throughputSensor(" RX", "cat "+shellQuote(filepath.Join(statistics, "rx_bytes")), "mdi:download-network"),
+				throughputSensor(" TX", "cat "+shellQuote(filepath.Join(statistics, "tx_bytes")), "mdi:upload-network"),
+			},
+		})
+	}
+	return items, nil
+}
+
+// throughputSensor returns the settings of a sensor deriving a throughput in bytes
+// per second from a command printing a number of bytes.
+func throughputSensor(suffix string, command string, icon string) SensorConfig {
+	return SensorConfig{
+		Name:              suffix,
+		Command:           command,
+		DeviceClass:       "data_rate",
+		StateClass:        "measurement",
+		UnitOfMeasurement: "B/s",
+		Icon:              icon,
+		Derive:            DERIVE_RATE,
+		Precision:         pointerTo(0),
+	}
+}
+
+// readSysfsValue reads a single value file of sysfs.
+func readSysfsValue(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// unescapeMountField decodes the octal escapes of a field of /proc/mounts.
+func unescapeMountField(field string) string {
+	return mountEscapePattern.ReplaceAllStringFunc(field, func(escape string) string {
+		code, _ := strconv.ParseUint(escape[1:], 8, 8)
+		return string(rune(code))
+	})
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+// discoverItems is not available outside Linux, whose sysfs describes the hardware.
+func discoverItems(kind string) ([]discoveredItem, error) {
+	return nil, fmt.Errorf("hardware autodiscovery is only supported on Linux")
+}
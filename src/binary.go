@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+const (
+	PLATFORM_SENSOR        = "sensor"
+	PLATFORM_BINARY_SENSOR = "binary_sensor"
+	PLATFORM_EVENT         = "event"
+	PLATFORM_BUTTON        = "button"
+
+	BINARY_ON  = "ON"
+	BINARY_OFF = "OFF"
+)
+
+// binaryEvaluator computes the state of a binary sensor.
+type binaryEvaluator interface {
+	evaluate(ctx context.Context) (bool, error)
+}
+
+// exitCodeEvaluator is on when its command exits with code 0.
+type exitCodeEvaluator struct {
+	command string
+}
+
+func (e *exitCodeEvaluator) evaluate(ctx context.Context) (bool, error) {
+	err := shellCommand(ctx, e.command).Run()
+	// A command stopped with the agent did not tell whether the sensor is off
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// outputEvaluator matches the output of its command against lists of on and off
+// values. When no off value is given, any value which is not an on value is off.
+type outputEvaluator struct {
+	command   string
+	onValues  []string
+	offValues []string
+}
+
+func (e *outputEvaluator) evaluate(ctx context.Context) (bool, error) {
+	output, err := shellCommand(ctx, e.command).Output()
+	if err != nil {
+		return false, err
+	}
+	value := strings.TrimSpace(string(output))
+	if slices.Contains(e.onValues, value) {
+		return true, nil
+	}
+	if len(e.offValues) == 0 || slices.Contains(e.offValues, value) {
+		return false, nil
+	}
+	return false, fmt.Errorf("value %q matches neither the on nor the off values", value)
+}
+
+// thresholdEvaluator compares the value of another sensor to a threshold.
+// Once on, the value has to cross back the threshold by the hysteresis before
+// the evaluator turns off, which avoids flapping around the threshold.
+//
+// Fields:
+// - target: The sensor whose value is compared.
+// - threshold: The threshold turning the evaluator on.
+// - above: Whether the evaluator is on above (true) or below (false) the threshold.
+// - hysteresis: The margin required to turn the evaluator off.
+// - on: The current state of the evaluator.
+type thresholdEvaluator struct {
+	target     *Sensor
+	threshold  float64
+	above      bool
+	hysteresis float64
+	on         bool
+}
+
+func (e *thresholdEvaluator) evaluate(ctx context.Context) (bool, error) {
+	reading := e.target.LastReading()
+	if reading.Err != nil {
+		return false, fmt.Errorf("sensor %q: %w", e.target.config.Name, reading.Err)
+	}
+	value, ok := reading.Value.(float64)
+	if !ok {
+		return false, fmt.Errorf("sensor %q has no numeric value", e.target.config.Name)
+	}
+
+	if e.above {
+		if value > e.threshold {
+			e.on = true
+		} else if value < e.threshold-e.hysteresis {
+			e.on = false
+		}
+	} else {
+		if value < e.threshold {
+			e.on = true
+		} else if value > e.threshold+e.hysteresis {
+			e.on = false
+		}
+	}
+	return e.on, nil
+}
+
+// NewBinarySensorFromConfig creates a new binary sensor from its configuration
+// file entry. Its state comes from the first source configured among:
+//   - a threshold on the value of another sensor of the device,
+//   - the output of a command matched against on and off values,
+//   - the exit code of a command (on when the command succeeds).
+//
+// Sensors referenced by thresholds must be added to the device beforehand.
+//
+// Parameters:
+//   - cfg: The binary sensor entry of the configuration file.
+//   - device: A pointer to the associated Device instance.
+//
+// Returns:
+//   - A pointer to the newly created Sensor instance.
+//   - An error if the configuration is invalid.
+func NewBinarySensorFromConfig(cfg BinarySensorConfig, device *Device) (*Sensor, error) {
+	sensor := NewSensor(cfg.Name, cfg.Command, cfg.DeviceClass, "", "", cfg.Icon, device)
+	sensor.config.Platform = PLATFORM_BINARY_SENSOR
+	sensor.invert = cfg.Invert
+
+	switch {
+	case cfg.Threshold != nil:
+		threshold := cfg.Threshold
+		target := device.GetSensorByName(threshold.Sensor)
+		if target == nil {
+			return nil, fmt.Errorf("binary sensor %q: unknown sensor %q", cfg.Name, threshold.Sensor)
+		}
+		if (threshold.Above == nil) == (threshold.Below == nil) {
+			return nil, fmt.Errorf("binary sensor %q: threshold needs exactly one of above or below", cfg.Name)
+		}
+		if threshold.Hysteresis < 0 {
+			return nil, fmt.Errorf("binary sensor %q: hysteresis must not be negative", cfg.Name)
+		}
+		evaluator := &thresholdEvaluator{target: target, hysteresis: threshold.Hysteresis}
+		if threshold.Above != nil {
+			evaluator.threshold, evaluator.above = *threshold.Above, true
+		} else {
+			evaluator.threshold = *threshold.Below
+		}
+		sensor.binary = evaluator
+	case cfg.Command == "":
+		return nil, fmt.Errorf("binary sensor %q: a command or a threshold is required", cfg.Name)
+	case len(cfg.OnValues) > 0:
+		sensor.binary = &outputEvaluator{command: cfg.Command, onValues: cfg.OnValues, offValues: cfg.OffValues}
+	case len(cfg.OffValues) > 0:
+		return nil, fmt.Errorf("binary sensor %q: off_values requires on_values", cfg.Name)
+	default:
+		sensor.binary = &exitCodeEvaluator{command: cfg.Command}
+	}
+
+	return sensor, nil
+}
+
+// formatBinaryState returns the payload of a binary sensor state.
+func formatBinaryState(on bool) string {
+	if on {
+		return BINARY_ON
+	}
+	return BINARY_OFF
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Collector is a source producing the readings of a dynamic set of entities,
+// such as a plugin. The device polls its collectors once per cycle and creates,
+// updates or removes its sensors to match the entities they return.
+type Collector interface {
+	// Name returns the name of the collector, used in logs and errors.
+	Name() string
+	// Collect returns the current entities of the collector and their values. It
+	// gives up when the context is cancelled.
+	Collect(ctx context.Context) ([]CollectedEntity, error)
+}
+
+// CollectedEntity represents an entity returned by a Collector along with its value.
+//
+// Fields:
+//   - Name: The name of the entity, unique within its device.
+//   - Platform: (Optional) The Home Assistant platform, "sensor", "binary_sensor", "event" or "button". Defaults to "sensor".
+//   - Value: The value of the entity: a number, a string or a boolean. Event and button entities have no value.
+//   - Unit: (Optional) The unit of measurement of the value.
+//   - DeviceClass: (Optional) The device class of the entity.
+//   - StateClass: (Optional) The state class of the entity.
+//   - Icon: (Optional) The icon of the entity.
+//   - Attributes: (Optional) The attributes of the entity.
+//   - EventTypes: The types of the events fired by an event entity.
+//   - Events: The events fired by an event entity since the previous collection. Every
+//     event holds its `event_type` and its attributes.
+//   - Device: (Optional) The child device the entity belongs to, instead of the device itself.
+type CollectedEntity struct {
+	Name        string           `json:"name"`
+	Platform    string           `json:"platform,omitempty"`
+	Value       any              `json:"value"`
+	Unit        string           `json:"unit,omitempty"`
+	DeviceClass string           `json:"device_class,omitempty"`
+	StateClass  string           `json:"state_class,omitempty"`
+	Icon        string           `json:"icon,omitempty"`
+	Attributes  map[string]any   `json:"attributes,omitempty"`
+	EventTypes  []string         `json:"event_types,omitempty"`
+	Events      []map[string]any `json:"events,omitempty"`
+	Device      *EntityDevice    `json:"device,omitempty"`
+}
+
+// EntityDevice describes a child device of the device, such as a container, whose
+// entities are returned by a collector. The child device is created with its
+// first entity and removed with its last one.
+//
+// Fields:
+//   - ID: The identifier of the child device, unique within the device and stable across restarts.
+//   - Name: The name of the child device.
+//   - Manufacturer: (Optional) The manufacturer of the child device.
+//   - Model: (Optional) The model of the child device.
+type EntityDevice struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Manufacturer string `json:"manufacturer,omitempty"`
+	Model        string `json:"model,omitempty"`
+}
+
+// removedComponent represents a component which disappeared from the device and
+// must be removed from Home Assistant by the next discovery message.
+type removedComponent struct {
+	key      string
+	platform string
+}
+
+// firedEvent represents an event fired by an event entity, waiting to be published.
+type firedEvent struct {
+	sensor  *Sensor
+	payload map[string]any
+}
+
+// AddCollector adds a collector to the device. The sensors of the collector are
+// created the first time it is collected.
+func (d *Device) AddCollector(collector Collector) {
+	d.collectors = append(d.collectors, collector)
+}
+
+// collectFrom polls a collector and synchronizes the sensors of the device and of
+// its children with the returned entities. When the collector fails, its sensors
+// are kept and report the error.
+func (d *Device) collectFrom(ctx context.Context, collector Collector, snapshot *Snapshot) {
+	start := time.Now()
+	entities, err := collector.Collect(ctx)
+	duration := time.Since(start)
+	if err != nil {
+		err = fmt.Errorf("collector %q: %w", collector.Name(), err)
+		reported := false
+		for _, device := range d.Devices() {
+			for _, sensor := range device.sensors {
+				if sensor.collector == collector {
+					sensor.last = Reading{Err: err, Time: start, Duration: duration}
+					snapshot.Of(device).Readings[sensor.Key()] = sensor.last
+					reported = true
+				}
+			}
+		}
+		// Without sensors yet, the error would not show up with their readings
+		if !reported {
+			slog.Warn("Error collecting entities", "collector", collector.Name(), "error", err)
+		}
+		return
+	}
+
+	// Names only differing by their punctuation share a key, the first entity wins
+	type entityKey struct {
+		device *Device
+		key    string
+	}
+	keys := map[entityKey]bool{}
+	seen := map[*Sensor]bool{}
+	for _, entity := range entities {
+		device, err := d.childDevice(entity.Device)
+		if err != nil {
+			slog.Warn("Error registering entity", "collector", collector.Name(), "entity", entity.Name, "error", err)
+			continue
+		}
+		key := entityKey{device: device, key: sensorKey(entity.Name)}
+		if keys[key] {
+			slog.Warn("Error registering entity: another entity has the same key", "collector", collector.Name(), "entity", entity.Name, "key", key.key)
+			continue
+		}
+		keys[key] = true
+		sensor, err := device.syncEntity(collector, entity)
+		if err != nil {
+			slog.Warn("Error registering entity", "collector", collector.Name(), "entity", entity.Name, "error", err)
+			continue
+		}
+		seen[sensor] = true
+
+		// Events are published on their own, they are not part of the state
+		if sensor.IsEvent() {
+			queueEvents(sensor, entity.Events, snapshot)
+			continue
+		}
+		if sensor.IsButton() {
+			continue
+		}
+		reading := Reading{Time: start, Duration: duration, Attributes: entity.Attributes}
+		reading.Value, reading.Err = normalizeEntityValue(sensor, entity.Value)
+		sensor.last = reading
+		snapshot.Of(device).Readings[sensor.Key()] = reading
+	}
+
+	// Remove the sensors of the entities which are gone, and the children left empty
+	for _, device := range d.Devices() {
+		kept := device.sensors[:0]
+		for _, sensor := range device.sensors {
+			if sensor.collector == collector && !seen[sensor] {
+				device.removed = append(device.removed, removedComponent{key: sensor.Key(), platform: sensor.config.Platform})
+				d.changed()
+				continue
+			}
+			kept = append(kept, sensor)
+		}
+		device.sensors = kept
+	}
+	d.pruneChildren()
+}
+
+// syncEntity returns the sensor of the given collector entity, creating it or
+// updating its metadata when needed.
+func (d *Device) syncEntity(collector Collector, entity CollectedEntity) (*Sensor, error) {
+	if entity.Name == "" {
+		return nil, fmt.Errorf("collector %q: entity without name", collector.Name())
+	}
+	if sensorKey(entity.Name) == "" {
+		return nil, fmt.Errorf("collector %q: entity %q has no letter or digit in its name", collector.Name(), entity.Name)
+	}
+	if entity.Platform == "" {
+		entity.Platform = PLATFORM_SENSOR
+	}
+	if !slices.Contains([]string{PLATFORM_SENSOR, PLATFORM_BINARY_SENSOR, PLATFORM_EVENT, PLATFORM_BUTTON}, entity.Platform) {
+		return nil, fmt.Errorf("collector %q: entity %q has unsupported platform %q", collector.Name(), entity.Name, entity.Platform)
+	}
+	if _, ok := collector.(commandHandler); entity.Platform == PLATFORM_BUTTON && !ok {
+		return nil, fmt.Errorf("collector %q: button %q cannot be pressed, the collector takes no commands", collector.Name(), entity.Name)
+	}
+	if entity.Platform == PLATFORM_EVENT && len(entity.EventTypes) == 0 {
+		return nil, fmt.Errorf("collector %q: event entity %q has no event types", collector.Name(), entity.Name)
+	}
+
+	config := sensorConfig{
+		Name:              entity.Name,
+		Platform:          entity.Platform,
+		DeviceClass:       entity.DeviceClass,
+		StateClass:        entity.StateClass,
+		UnitOfMeasurement: entity.Unit,
+		Icon:              entity.Icon,
+		Transform:         &Transform{},
+		Precision:         DEFAULT_PRECISION,
+		Attributes:        len(entity.Attributes) > 0 && entity.Platform != PLATFORM_EVENT && entity.Platform != PLATFORM_BUTTON,
+		EventTypes:        entity.EventTypes,
+		Generated:         true,
+	}
+
+	key := sensorKey(entity.Name)
+	for _, sensor := range d.sensors {
+		if sensor.Key() != key {
+			continue
+		}
+		if sensor.collector != collector {
+			return nil, fmt.Errorf("collector %q: entity %q conflicts with another sensor", collector.Name(), entity.Name)
+		}
+		// Keep the attributes topic once announced, entities often omit empty attributes
+		config.Attributes = config.Attributes || sensor.config.Attributes
+		config.Transform = sensor.config.Transform
+		if !reflect.DeepEqual(*sensor.config, config) {
+			*sensor.config = config
+			d.changed()
+		}
+		return sensor, nil
+	}
+
+	sensor := &Sensor{
+		config:    &config,
+		collector: collector,
+		Device:    d,
+	}
+	d.sensors = append(d.sensors, sensor)
+	d.removed = slices.DeleteFunc(d.removed, func(removed removedComponent) bool {
+		return removed.key == key
+	})
+	d.changed()
+	return sensor, nil
+}
+
+// queueEvents validates the events fired by an event entity, of the device or of
+// one of its children, and adds them to the snapshot. An event without type gets
+// the type of the entity when it has only one.
+func queueEvents(sensor *Sensor, events []map[string]any, snapshot *Snapshot) {
+	for _, event := range events {
+		eventType, _ := event["event_type"].(string)
+		if eventType == "" && len(sensor.config.EventTypes) == 1 {
+			eventType = sensor.config.EventTypes[0]
+			event["event_type"] = eventType
+		}
+		if !slices.Contains(sensor.config.EventTypes, eventType) {
+			slog.Warn("Error firing event: unknown event type", "sensor", sensor.Key(), "event_type", eventType)
+			continue
+		}
+		snapshot.Events = append(snapshot.Events, firedEvent{sensor: sensor, payload: event})
+	}
+}
+
+// normalizeEntityValue converts the value of a collector entity to the value
+// published by its sensor, the same way command sensors do.
+func normalizeEntityValue(sensor *Sensor, value any) (any, error) {
+	if sensor.IsBinary() {
+		switch value := value.(type) {
+		case bool:
+			return formatBinaryState(value), nil
+		case float64:
+			return formatBinaryState(value != 0), nil
+		case string:
+			if value == BINARY_ON || value == BINARY_OFF {
+				return value, nil
+			}
+			on, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("value %q is not a binary state", value)
+			}
+			return formatBinaryState(on), nil
+		}
+		return nil, fmt.Errorf("value %v is not a binary state", value)
+	}
+
+	switch value := value.(type) {
+	case float64:
+		if sensor.IsEnum() {
+			return strconv.FormatFloat(value, 'f', -1, 64), nil
+		}
+		return RoundValue(value, sensor.config.Precision), nil
+	case string:
+		if sensor.IsEnum() {
+			return value, nil
+		}
+		floatValue, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("value %q is not numeric: %w", value, err)
+		}
+		return RoundValue(floatValue, sensor.config.Precision), nil
+	case nil:
+		return nil, ErrNoValue
+	}
+	return nil, fmt.Errorf("value %v is neither a number nor a string", value)
+}
+
+// ConfigRevision returns a number which changes every time the set of components
+// of the device changes, meaning that the discovery message must be published again.
+func (d *Device) ConfigRevision() int {
+	return d.revision
+}
+
+// GetRemovedComponents returns the components removed from the device since the
+// last call to ForgetRemovedComponents.
+func (d *Device) GetRemovedComponents() []removedComponent {
+	return d.removed
+}
+
+// ForgetRemovedComponents clears the list of removed components, once their
+// removal has been announced to Home Assistant.
+func (d *Device) ForgetRemovedComponents() {
+	d.removed = nil
+}
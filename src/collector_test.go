@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+// staticCollector is a Collector returning the same entities at every collection.
+type staticCollector struct {
+	entities []CollectedEntity
+}
+
+func (c *staticCollector) Name() string {
+	return "static"
+}
+
+func (c *staticCollector) Collect(ctx context.Context) ([]CollectedEntity, error) {
+	return c.entities, nil
+}
+
+// collectedComponents collects the entities once and returns the components of
+// the discovery message of the device.
+func collectedComponents(t *testing.T, device *Device, entities ...CollectedEntity) map[string]component {
+	t.Helper()
+	device.AddCollector(&staticCollector{entities: entities})
+	if _, err := device.Collect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	config, err := FormatMQTTConfig(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var discovery autoDiscoveryDeviceMQTT
+	if err := json.Unmarshal([]byte(config), &discovery); err != nil {
+		t.Fatal(err)
+	}
+	return discovery.Components
+}
+
+func TestCollectedEntityKeys(t *testing.T) {
+	device := NewDevice("Host", "Manufacturer", "Model", "host-sn")
+	components := collectedComponents(t, device,
+		CollectedEntity{Name: "Check Root Disk /", Value: 42.0},
+		CollectedEntity{Name: "Mail @ 50% /var/mail", Value: 1.0},
+	)
+
+	for key, name := range map[string]string{
+		"check_root_disk":  "Check Root Disk /",
+		"mail_50_var_mail": "Mail @ 50% /var/mail",
+	} {
+		sensor := device.GetSensorByName(name)
+		if sensor == nil {
+			t.Fatalf("no sensor named %q", name)
+		}
+		if sensor.Key() != key {
+			t.Errorf("key of %q = %q, want %q", name, sensor.Key(), key)
+		}
+		component, ok := components[key]
+		if !ok {
+			t.Fatalf("no %q component in %v", key, components)
+		}
+		if want := "{{ value_json." + key + " }}"; component.ValueTemplate != want {
+			t.Errorf("value_template of %q = %q, want %q", name, component.ValueTemplate, want)
+		}
+	}
+}
+
+func TestCollectedEntityWithoutKey(t *testing.T) {
+	device := NewDevice("Host", "Manufacturer", "Model", "host-sn")
+	if _, err := device.syncEntity(&staticCollector{}, CollectedEntity{Name: "/"}); err == nil {
+		t.Error("syncEntity() accepted an entity whose key is empty")
+	}
+}
+
+func TestCollectedEntitiesSharingKey(t *testing.T) {
+	device := NewDevice("Host", "Manufacturer", "Model", "host-sn")
+	collectedComponents(t, device,
+		CollectedEntity{Name: "Queue a-b", Value: 1.0},
+		CollectedEntity{Name: "Queue a_b", Value: 2.0},
+	)
+	sensor := device.GetSensorByName("Queue a-b")
+	if sensor == nil || sensor.LastReading().Value != 1.0 {
+		t.Fatalf("the first entity is not kept")
+	}
+	if device.GetSensorByName("Queue a_b") != nil {
+		t.Error("the second entity replaced the first one")
+	}
+}
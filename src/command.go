@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// COMMAND_QUEUE_SIZE is the number of received commands waiting for the main loop.
+// Commands received while the queue is full are dropped.
+const COMMAND_QUEUE_SIZE = 16
+
+// commandHandler is implemented by the collectors whose entities accept commands
+// from Home Assistant, such as buttons.
+type commandHandler interface {
+	// Command executes a command received for an entity of the collector.
+	//
+	// Parameters:
+	//   - ctx: Stops the command when cancelled.
+	//   - device: The ID of the child device of the entity, empty for the device itself.
+	//   - entity: The name of the entity.
+	//   - payload: The payload of the command, e.g. PRESS for a button.
+	Command(ctx context.Context, device string, entity string, payload string) error
+}
+
+// deviceCommand represents a command received from the MQTT server, waiting to be
+// handled by the main loop.
+type deviceCommand struct {
+	topic   string
+	payload string
+}
+
+// AcceptsCommands reports whether a collector of the device or of its children
+// takes commands, in which case the command topics must be subscribed.
+func (d *Device) AcceptsCommands() bool {
+	for _, device := range d.Devices() {
+		for _, collector := range device.collectors {
+			if _, ok := collector.(commandHandler); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// QueueCommand queues a command received on an MQTT topic for the main loop. It
+// never blocks, as it is called by the MQTT client.
+func (d *Device) QueueCommand(topic string, payload string) {
+	select {
+	case d.commands <- deviceCommand{topic: topic, payload: payload}:
+	default:
+		slog.Warn("Command queue full, dropping command", "topic", topic)
+	}
+}
+
+// Commands returns the channel of the commands received from the MQTT server.
+func (d *Device) Commands() <-chan deviceCommand {
+	return d.commands
+}
+
+// HandleCommand executes a command on the entity whose command topic received it.
+// Commands for the buttons which are gone are ignored.
+func (d *Device) HandleCommand(ctx context.Context, command deviceCommand) error {
+	for _, device := range d.Devices() {
+		for _, sensor := range device.sensors {
+			if !sensor.IsButton() || GetCommandTopic(device, sensor) != command.topic {
+				continue
+			}
+			handler, ok := sensor.collector.(commandHandler)
+			if !ok {
+				return fmt.Errorf("entity %q takes no commands", sensor.config.Name)
+			}
+			if err := handler.Command(ctx, device.id, sensor.config.Name, command.payload); err != nil {
+				return fmt.Errorf("command of %q: %w", sensor.config.Name, err)
+			}
+			slog.Info("Command executed", "entity", sensor.config.Name, "device", device.GetDeviceInfo().Name)
+			return nil
+		}
+	}
+	return nil
+}
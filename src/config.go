@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
@@ -13,6 +15,7 @@ import (
 // Fields:
 // - Software: Contains software-related configurations such as the refresh period.
 //   - RefreshPeriodS: The refresh period in seconds.
+//   - StateFile: (Optional) The file where the state of counter sensors is persisted.
 //
 // - Device: Contains information about the device.
 //   - Name: The name of the device.
@@ -20,21 +23,64 @@ import (
 //   - Model: The model of the device.
 //   - SerialNumber: The serial number of the device.
 //
-// - MQTTServer: Contains the configuration for the MQTT server.
+// - MQTTServer: (Optional) Contains the configuration for the MQTT server, used when its IP is set.
 //   - IP: The IP address of the MQTT server.
 //   - Port: The port of the MQTT server.
 //   - Username: The username for MQTT server authentication.
 //   - Password: The password for MQTT server authentication.
 //
+// - BinarySensors: A list of binary sensor configurations, see BinarySensorConfig.
+//
+// - Plugins: A list of plugin configurations, see PluginConfig.
+//
+// - LogWatchers: A list of log file watchers, see LogWatcherConfig.
+//
+// - Autodiscover: (Optional) The hardware for which sensors are generated, see AutodiscoverConfig.
+//
+// - Processes: A list of monitored process groups, see ProcessConfig.
+//
+// - SystemdUnits: (Optional) The systemd units whose state is published, see SystemdUnitsConfig.
+//
+// - Docker: (Optional) The Docker containers published as devices of their own, see DockerConfig.
+//
+// - Devices: (Optional) The devices attached to the host, with sensors of their own, see ChildDeviceConfig.
+//
+// - PrometheusExporter: (Optional) The HTTP listener exposing the readings to Prometheus, see PrometheusExporterConfig.
+//
+// - PrometheusSources: (Optional) The endpoints and files of Prometheus metrics published as entities, see PrometheusSourceConfig.
+//
+// - Sinks: (Optional) The destinations of the readings besides the MQTT server, see SinkConfig.
+//
+// - StatusAPI: (Optional) The local HTTP server showing the state of the agent, see StatusAPIConfig.
+//
+// - Logging: (Optional) The level, format and output of the logs, see LoggingConfig.
+//
 // - Sensors: A list of sensor configurations.
+//   - Type: (Optional) "command" (default), "stream" for a long-running command publishing
+//     every line, or "nagios" for a Monitoring-Plugins-compatible check.
 //   - Name: The name of the sensor.
 //   - Command: The command associated with the sensor.
 //   - DeviceClass: The device class of the sensor.
 //   - StateClass: The state class of the sensor.
 //   - UnitOfMeasurement: The unit of measurement for the sensor's data.
+//   - Icon: (Optional) The icon of the sensor.
+//   - Transform: (Optional) The post-processing steps applied to the command output.
+//   - Precision: (Optional) The number of decimals kept when publishing numeric values.
+//   - Derive: (Optional) Derives a rate or a total from a monotonically increasing counter.
+//   - CounterMax: (Optional) The value at which the derived counter wraps.
+//   - Sampling: (Optional) Samples the sensor in the background and publishes aggregates.
+//   - MinChange: (Optional) The minimum change, absolute or in percent, required to publish a value.
+//   - MaxSilenceS: (Optional) The maximum time in seconds between two publications of the sensor.
+//   - ExpireAfterS: (Optional) The time in seconds after which Home Assistant marks the sensor unavailable.
+//   - ValueField: (Optional) Reads the value from this field of a JSON object output by the command.
+//   - Attributes: (Optional) The sources of the attributes published with the sensor.
+//   - TimeoutS: (Optional) The time in seconds a nagios check is given to complete.
+//   - UniqueID: (Optional) The unique identifier of the sensor in Home Assistant.
+//   - ForEach: (Optional) Turns the sensor into a template repeated for every item of a list.
 type Config struct {
 	Software struct {
-		RefreshPeriodS int `yaml:"refresh_period_s"`
+		RefreshPeriodS int    `yaml:"refresh_period_s"`
+		StateFile      string `yaml:"state_file,omitempty"`
 	} `yaml:"software"`
 
 	Device struct {
@@ -51,14 +97,469 @@ type Config struct {
 		Password string `yaml:"password"`
 	} `yaml:"mqtt_server"`
 
-	Sensors []struct {
-		Name              string `yaml:"name"`
-		Command           string `yaml:"command"`
-		DeviceClass       string `yaml:"device_class"`
-		StateClass        string `yaml:"state_class"`
-		UnitOfMeasurement string `yaml:"unit_of_measurement"`
-		Icon              string `yaml:"icon,omitempty"`
-	} `yaml:"sensors"`
+	Sensors       []SensorConfig       `yaml:"sensors"`
+	BinarySensors []BinarySensorConfig `yaml:"binary_sensors,omitempty"`
+	Plugins       []PluginConfig       `yaml:"plugins,omitempty"`
+	LogWatchers   []LogWatcherConfig   `yaml:"log_watchers,omitempty"`
+	Autodiscover  *AutodiscoverConfig  `yaml:"autodiscover,omitempty"`
+	Processes     []ProcessConfig      `yaml:"processes,omitempty"`
+	SystemdUnits  *SystemdUnitsConfig  `yaml:"systemd_units,omitempty"`
+	Docker        *DockerConfig        `yaml:"docker,omitempty"`
+	Devices       []ChildDeviceConfig  `yaml:"devices,omitempty"`
+
+	PrometheusExporter *PrometheusExporterConfig `yaml:"prometheus_exporter,omitempty"`
+	PrometheusSources  []PrometheusSourceConfig  `yaml:"prometheus_sources,omitempty"`
+
+	Sinks     []SinkConfig     `yaml:"sinks,omitempty"`
+	StatusAPI *StatusAPIConfig `yaml:"status_api,omitempty"`
+	Logging   LoggingConfig    `yaml:"logging,omitempty"`
+}
+
+// SensorConfig represents the configuration of a single sensor as declared in the
+// `sensors` section of the configuration file.
+type SensorConfig struct {
+	Type              string            `yaml:"type,omitempty"`
+	Name              string            `yaml:"name"`
+	Command           string            `yaml:"command"`
+	DeviceClass       string            `yaml:"device_class"`
+	StateClass        string            `yaml:"state_class"`
+	UnitOfMeasurement string            `yaml:"unit_of_measurement"`
+	Icon              string            `yaml:"icon,omitempty"`
+	Transform         []TransformStep   `yaml:"transform,omitempty"`
+	Precision         *int              `yaml:"precision,omitempty"`
+	Derive            string            `yaml:"derive,omitempty"`
+	CounterMax        float64           `yaml:"counter_max,omitempty"`
+	Sampling          *SamplingConfig   `yaml:"sampling,omitempty"`
+	MinChange         *ChangeThreshold  `yaml:"min_change,omitempty"`
+	MaxSilenceS       int               `yaml:"max_silence_s,omitempty"`
+	ExpireAfterS      int               `yaml:"expire_after_s,omitempty"`
+	ValueField        string            `yaml:"value_field,omitempty"`
+	Attributes        *AttributesConfig `yaml:"attributes,omitempty"`
+	TimeoutS          int               `yaml:"timeout_s,omitempty"`
+	UniqueID          string            `yaml:"unique_id,omitempty"`
+	ForEach           *ForEachConfig    `yaml:"for_each,omitempty"`
+	// Discovered is set for the sensors generated by the autodiscovery.
+	Discovered bool `yaml:"-"`
+	// Generated is set for the sensors generated by a template, named after their item.
+	Generated bool `yaml:"-"`
+}
+
+// AttributesConfig represents the sources of the attributes of a sensor.
+// When the sensor reads its value from a `value_field`, the other fields of the
+// output are always part of the attributes.
+//
+// Fields:
+// - Command: (Optional) A command printing a JSON object or `key=value` lines.
+// - Diagnostics: (Optional) Adds the exit code, error output and duration of the sensor command.
+type AttributesConfig struct {
+	Command     string `yaml:"command,omitempty"`
+	Diagnostics bool   `yaml:"diagnostics,omitempty"`
+}
+
+// BinarySensorConfig represents the configuration of a binary sensor as declared in
+// the `binary_sensors` section of the configuration file.
+//
+// Fields:
+// - Name: The name of the binary sensor.
+// - DeviceClass: (Optional) The device class of the binary sensor (e.g. problem, connectivity).
+// - Icon: (Optional) The icon of the binary sensor.
+// - Command: The command providing the state, unless a threshold is used.
+// - OnValues: (Optional) The outputs of the command meaning on. Without it, the exit code is used.
+// - OffValues: (Optional) The outputs of the command meaning off. Defaults to any other output.
+// - Invert: (Optional) Inverts the state of the binary sensor.
+// - Threshold: (Optional) Derives the state from the value of another sensor.
+type BinarySensorConfig struct {
+	Name        string           `yaml:"name"`
+	DeviceClass string           `yaml:"device_class,omitempty"`
+	Icon        string           `yaml:"icon,omitempty"`
+	Command     string           `yaml:"command,omitempty"`
+	OnValues    []string         `yaml:"on_values,omitempty"`
+	OffValues   []string         `yaml:"off_values,omitempty"`
+	Invert      bool             `yaml:"invert,omitempty"`
+	Threshold   *ThresholdConfig `yaml:"threshold,omitempty"`
+}
+
+// ThresholdConfig represents a threshold on the value of a sensor.
+//
+// Fields:
+// - Sensor: The name of the sensor whose value is compared.
+// - Above: The value above which the binary sensor is on.
+// - Below: The value below which the binary sensor is on.
+// - Hysteresis: (Optional) The margin the value has to cross back before turning off.
+type ThresholdConfig struct {
+	Sensor     string   `yaml:"sensor"`
+	Above      *float64 `yaml:"above,omitempty"`
+	Below      *float64 `yaml:"below,omitempty"`
+	Hysteresis float64  `yaml:"hysteresis,omitempty"`
+}
+
+// PluginConfig represents the configuration of a plugin as declared in the
+// `plugins` section of the configuration file.
+//
+// Fields:
+//   - Name: The name of the plugin.
+//   - Command: The command running the plugin.
+//   - Mode: (Optional) "exec" to run the plugin at every cycle (default), or "persistent"
+//     to keep it running and exchange requests over its standard input and output.
+//   - TimeoutS: (Optional) The time in seconds the plugin is given to print its entities.
+type PluginConfig struct {
+	Name     string `yaml:"name"`
+	Command  string `yaml:"command"`
+	Mode     string `yaml:"mode,omitempty"`
+	TimeoutS int    `yaml:"timeout_s,omitempty"`
+}
+
+// LogWatcherConfig represents a log file followed by the agent, as declared in
+// the `log_watchers` section of the configuration file.
+//
+// Fields:
+// - Path: The path of the log file.
+// - Matches: The regular expressions searched in the new lines of the file.
+type LogWatcherConfig struct {
+	Path    string           `yaml:"path"`
+	Matches []LogMatchConfig `yaml:"matches"`
+}
+
+// LogMatchConfig represents a regular expression searched in a log file and the
+// entity reporting its matches.
+//
+// Fields:
+//   - Name: The name of the entity.
+//   - Regex: The regular expression matched against every new line.
+//   - Type: (Optional) "count" for the number of matches (default), "rate" for the
+//     matches per minute, or "last_match" for the last matching line.
+//   - Icon: (Optional) The icon of the entity.
+//   - Event: (Optional) Also fires a Home Assistant event at every match.
+type LogMatchConfig struct {
+	Name  string `yaml:"name"`
+	Regex string `yaml:"regex"`
+	Type  string `yaml:"type,omitempty"`
+	Icon  string `yaml:"icon,omitempty"`
+	Event bool   `yaml:"event,omitempty"`
+}
+
+// ProcessConfig represents a group of processes monitored by the agent, as declared
+// in the `processes` section of the configuration file. Exactly one way of matching
+// the processes must be set.
+//
+// Fields:
+// - Name: The name of the group, prefixing the names of its entities.
+// - ProcessName: The name of the processes' executable.
+// - Cmdline: A regular expression matched against the command line of the processes.
+// - Pidfile: A file holding the PID of the main process, whose children are also part of the group.
+// - SystemdUnit: The systemd unit whose control group holds the processes.
+type ProcessConfig struct {
+	Name        string `yaml:"name"`
+	ProcessName string `yaml:"process_name,omitempty"`
+	Cmdline     string `yaml:"cmdline,omitempty"`
+	Pidfile     string `yaml:"pidfile,omitempty"`
+	SystemdUnit string `yaml:"systemd_unit,omitempty"`
+}
+
+// SystemdUnitsConfig represents the systemd units monitored by the agent, as
+// declared in the `systemd_units` section of the configuration file. The number
+// of failed units of the host is always published.
+//
+// Fields:
+// - Units: (Optional) The names of the units whose state is published, e.g. "nginx" or "backup.timer".
+type SystemdUnitsConfig struct {
+	Units []string `yaml:"units,omitempty"`
+}
+
+// ChildDeviceConfig represents a device declared in the `devices` section of the
+// configuration file, such as a virtual machine of the host or a disk of a NAS. It
+// is announced to Home Assistant as a device of its own, linked to the host, with
+// its own sensors.
+//
+// Fields:
+// - ID: (Optional) The identifier of the device, unique within the host. Defaults to its name.
+// - Name: The name of the device.
+// - Manufacturer: (Optional) The manufacturer of the device.
+// - Model: (Optional) The model of the device.
+// - Sensors: The sensors of the device, configured like the sensors of the host.
+// - BinarySensors: (Optional) The binary sensors of the device, whose thresholds refer to its sensors.
+type ChildDeviceConfig struct {
+	ID            string               `yaml:"id,omitempty"`
+	Name          string               `yaml:"name"`
+	Manufacturer  string               `yaml:"manufacturer,omitempty"`
+	Model         string               `yaml:"model,omitempty"`
+	Sensors       []SensorConfig       `yaml:"sensors"`
+	BinarySensors []BinarySensorConfig `yaml:"binary_sensors,omitempty"`
+}
+
+// PrometheusExporterConfig represents the HTTP listener exposing the readings of the
+// sensors to Prometheus, as declared in the `prometheus_exporter` section of the
+// configuration file.
+//
+// Fields:
+// - Listen: The address the listener is bound to, e.g. ":9150" or "127.0.0.1:9150".
+// - Path: (Optional) The path of the metrics. Defaults to /metrics.
+type PrometheusExporterConfig struct {
+	Listen string `yaml:"listen"`
+	Path   string `yaml:"path,omitempty"`
+}
+
+// PrometheusSourceConfig represents a source of metrics in the Prometheus exposition
+// format, as declared in the `prometheus_sources` section of the configuration file:
+// an HTTP endpoint or a file of the node_exporter textfile collector.
+//
+// Fields:
+// - Name: (Optional) The name of the source, used in logs and errors. Defaults to its URL or file.
+// - URL: The URL scraped at every refresh, unless a file is set.
+// - File: The file read at every refresh, unless a URL is set.
+// - TimeoutS: (Optional) The time in seconds the endpoint is given to answer. Defaults to 10.
+// - Metrics: The series to publish and the entities they are mapped to.
+type PrometheusSourceConfig struct {
+	Name     string                   `yaml:"name,omitempty"`
+	URL      string                   `yaml:"url,omitempty"`
+	File     string                   `yaml:"file,omitempty"`
+	TimeoutS int                      `yaml:"timeout_s,omitempty"`
+	Metrics  []PrometheusMetricConfig `yaml:"metrics"`
+}
+
+// PrometheusMetricConfig represents the series of a Prometheus source mapped to
+// entities, one entity per selected series.
+//
+// Fields:
+//   - Name: The template of the names of the entities, rendered with the labels of the
+//     series (e.g. "Free Space {{.mountpoint}}").
+//   - Metric: The selector of the series, a metric name followed by optional label
+//     matchers (e.g. `node_filesystem_avail_bytes{fstype!="tmpfs"}`).
+//   - DeviceClass: (Optional) The device class of the entities.
+//   - StateClass: (Optional) The state class of the entities.
+//   - UnitOfMeasurement: (Optional) The unit of the entities, after the transformation.
+//   - Icon: (Optional) The icon of the entities.
+//   - Transform: (Optional) The steps applied to the values of the series.
+type PrometheusMetricConfig struct {
+	Name              string          `yaml:"name"`
+	Metric            string          `yaml:"metric"`
+	DeviceClass       string          `yaml:"device_class,omitempty"`
+	StateClass        string          `yaml:"state_class,omitempty"`
+	UnitOfMeasurement string          `yaml:"unit_of_measurement,omitempty"`
+	Icon              string          `yaml:"icon,omitempty"`
+	Transform         []TransformStep `yaml:"transform,omitempty"`
+}
+
+// LoggingConfig represents the logs of the agent, as declared in the `logging` section
+// of the configuration file.
+//
+// Fields:
+// - Level: (Optional) "debug", "info", "warn" or "error". Defaults to "info".
+// - Format: (Optional) "text" or "json". Defaults to "text", ignored by journald.
+// - Output: (Optional) "stderr", "stdout" or "journald". Defaults to "stderr".
+// - RepeatIntervalS: (Optional) The time in seconds during which a repeated warning or error is only logged once. Defaults to 300.
+type LoggingConfig struct {
+	Level           string `yaml:"level,omitempty"`
+	Format          string `yaml:"format,omitempty"`
+	Output          string `yaml:"output,omitempty"`
+	RepeatIntervalS int    `yaml:"repeat_interval_s,omitempty"`
+}
+
+// StatusAPIConfig represents the local HTTP server showing what the agent sees, as
+// declared in the `status_api` section of the configuration file.
+//
+// Fields:
+// - Listen: The address the server is bound to, e.g. "127.0.0.1:9151".
+// - Token: (Optional) The bearer token required by every endpoint but /healthz.
+type StatusAPIConfig struct {
+	Listen string `yaml:"listen"`
+	Token  string `yaml:"token,omitempty"`
+}
+
+// SinkConfig represents a destination of the readings, as declared in the `sinks`
+// section of the configuration file. The fields used depend on its type.
+//
+// Fields:
+//   - Type: "influxdb", "homeassistant", "webhook", "file" or "stdout".
+//   - URL: The URL of the InfluxDB v2 server (influxdb), of Home Assistant (homeassistant)
+//     or of the webhook (webhook).
+//   - Org: The organization owning the bucket (influxdb).
+//   - Bucket: The bucket the points are written to (influxdb).
+//   - Token: The API token of the InfluxDB server (influxdb), or the long-lived access token
+//     of a Home Assistant user (homeassistant).
+//   - Measurement: (Optional) The measurement of the points. Defaults to "penguinhomelink" (influxdb).
+//   - TimeoutS: (Optional) The time in seconds the server is given to answer. Defaults to 10
+//     (influxdb, homeassistant, webhook).
+//   - Retries: (Optional) The number of times a failed request is retried, with an
+//     exponential backoff. Defaults to 3 (homeassistant, webhook).
+//   - Method: (Optional) The HTTP method of the requests. Defaults to POST (webhook).
+//   - Headers: (Optional) The headers added to the requests (webhook).
+//   - Body: (Optional) The text/template of the body of the requests. Defaults to the
+//     data of the template as JSON (webhook).
+//   - Mode: (Optional) "cycle" for a request per refresh, or "sensor" for a request per
+//     sensor whose value changed. Defaults to "cycle" (webhook).
+//   - Secret: (Optional) The secret signing the body with HMAC-SHA256 (webhook).
+//   - DeadLetter: (Optional) The file where the failed deliveries are kept (webhook).
+//   - Path: The file the JSON lines are appended to (file).
+//   - MaxSizeMB: (Optional) The size in MB at which the file is rotated. Defaults to 10 (file).
+//   - MaxFiles: (Optional) The number of rotated files kept. Defaults to 5 (file).
+type SinkConfig struct {
+	Type        string            `yaml:"type"`
+	URL         string            `yaml:"url,omitempty"`
+	Org         string            `yaml:"org,omitempty"`
+	Bucket      string            `yaml:"bucket,omitempty"`
+	Token       string            `yaml:"token,omitempty"`
+	Measurement string            `yaml:"measurement,omitempty"`
+	TimeoutS    int               `yaml:"timeout_s,omitempty"`
+	Retries     *int              `yaml:"retries,omitempty"`
+	Method      string            `yaml:"method,omitempty"`
+	Headers     map[string]string `yaml:"headers,omitempty"`
+	Body        string            `yaml:"body,omitempty"`
+	Mode        string            `yaml:"mode,omitempty"`
+	Secret      string            `yaml:"secret,omitempty"`
+	DeadLetter  string            `yaml:"dead_letter,omitempty"`
+	Path        string            `yaml:"path,omitempty"`
+	MaxSizeMB   int               `yaml:"max_size_mb,omitempty"`
+	MaxFiles    int               `yaml:"max_files,omitempty"`
+}
+
+// DockerConfig represents the Docker containers monitored by the agent, as declared
+// in the `docker` section of the configuration file. Every container becomes a
+// device of its own in Home Assistant, linked to the host.
+//
+// Fields:
+// - Socket: (Optional) The socket of the Docker Engine API. Defaults to /var/run/docker.sock.
+// - Include: (Optional) The glob patterns of the names of the containers to monitor. Defaults to every container.
+// - Exclude: (Optional) The glob patterns of the names of the containers to skip.
+// - Buttons: (Optional) Whether start, stop and restart buttons are published for every container.
+type DockerConfig struct {
+	Socket  string   `yaml:"socket,omitempty"`
+	Include []string `yaml:"include,omitempty"`
+	Exclude []string `yaml:"exclude,omitempty"`
+	Buttons bool     `yaml:"buttons,omitempty"`
+}
+
+// AutodiscoverConfig represents the hardware enumerated at startup and on reload to
+// generate sensors, as declared in the `autodiscover` section of the configuration file.
+// A source left out of the section is not enumerated.
+//
+// Fields:
+// - Hwmon: (Optional) The temperature, fan, voltage and power inputs of /sys/class/hwmon.
+// - Thermal: (Optional) The thermal zones of /sys/class/thermal.
+// - Block: (Optional) The read and write throughput of the disks of /sys/block.
+// - Mounts: (Optional) The usage of the filesystems mounted from a device, from /proc/mounts.
+// - Net: (Optional) The receive and transmit throughput of the interfaces of /sys/class/net.
+type AutodiscoverConfig struct {
+	Hwmon   *DiscoverySourceConfig `yaml:"hwmon,omitempty"`
+	Thermal *DiscoverySourceConfig `yaml:"thermal,omitempty"`
+	Block   *DiscoverySourceConfig `yaml:"block,omitempty"`
+	Mounts  *DiscoverySourceConfig `yaml:"mounts,omitempty"`
+	Net     *DiscoverySourceConfig `yaml:"net,omitempty"`
+}
+
+// DiscoverySourceConfig represents the settings of a hardware source of the
+// autodiscovery.
+//
+// Fields:
+//   - Include: (Optional) The glob patterns of the items to keep. Defaults to every item.
+//   - Exclude: (Optional) The glob patterns of the items to skip. Defaults to the virtual
+//     devices of the source.
+//   - Name: (Optional) The text/template generating the names of the sensors.
+//   - Icon: (Optional) The icon of the generated sensors.
+//   - MinChange: (Optional) The minimum change required to publish a value, see SensorConfig.
+//   - MaxSilenceS: (Optional) The maximum time in seconds between two publications of a value.
+type DiscoverySourceConfig struct {
+	Include     []string         `yaml:"include,omitempty"`
+	Exclude     []string         `yaml:"exclude,omitempty"`
+	Name        string           `yaml:"name,omitempty"`
+	Icon        string           `yaml:"icon,omitempty"`
+	MinChange   *ChangeThreshold `yaml:"min_change,omitempty"`
+	MaxSilenceS int              `yaml:"max_silence_s,omitempty"`
+}
+
+// ForEachConfig represents the items a sensor template is repeated for. It is
+// written either as a list of items, scalars or mappings, or as a mapping holding
+// a command whose output lines are the items.
+//
+// Fields:
+// - Items: The static items of the template.
+// - Command: The command printing one item per line.
+type ForEachConfig struct {
+	Items   []any
+	Command string
+}
+
+// UnmarshalYAML decodes a ForEachConfig from either a list or a command.
+func (f *ForEachConfig) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.SequenceNode {
+		return node.Decode(&f.Items)
+	}
+	var source struct {
+		Command string `yaml:"command"`
+	}
+	if err := node.Decode(&source); err != nil || source.Command == "" {
+		return fmt.Errorf("line %d: for_each must be a list or a command", node.Line)
+	}
+	f.Command = source.Command
+	return nil
+}
+
+// ChangeThreshold represents a minimum change between two values. It is written
+// either as a number for an absolute change (e.g. 0.5) or as a string ending with
+// "%" for a change relative to the previous value (e.g. "5%").
+type ChangeThreshold struct {
+	Value   float64
+	Percent bool
+}
+
+// UnmarshalYAML decodes a ChangeThreshold from either a number or a percentage.
+func (t *ChangeThreshold) UnmarshalYAML(node *yaml.Node) error {
+	var raw string
+	if err := node.Decode(&raw); err != nil {
+		return err
+	}
+	raw = strings.TrimSpace(raw)
+	if strings.HasSuffix(raw, "%") {
+		t.Percent = true
+		raw = strings.TrimSpace(strings.TrimSuffix(raw, "%"))
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil || value < 0 {
+		return fmt.Errorf("line %d: invalid change threshold %q", node.Line, node.Value)
+	}
+	t.Value = value
+	return nil
+}
+
+// SamplingConfig represents the background sampling settings of a sensor.
+//
+// Fields:
+// - PeriodS: The interval in seconds between two samples.
+// - Aggregate: (Optional) The aggregate published by the sensor itself. Defaults to "mean".
+// - Expose: (Optional) Additional aggregates published as their own entities.
+type SamplingConfig struct {
+	PeriodS   int      `yaml:"period_s"`
+	Aggregate string   `yaml:"aggregate,omitempty"`
+	Expose    []string `yaml:"expose,omitempty"`
+}
+
+// TransformStep represents a single post-processing operation applied to the raw
+// output of a sensor command. Exactly one of the fields must be set per step.
+//
+// Fields:
+// - Regex: Extracts the first capture group (or the whole match) of a regular expression.
+// - StripPrefix: Removes a prefix from the value.
+// - StripSuffix: Removes a suffix from the value (e.g. "%").
+// - Multiply: Multiplies the numeric value by a factor.
+// - Offset: Adds an offset to the numeric value.
+// - Convert: Applies a named unit conversion (e.g. "millicelsius_to_celsius").
+// - Clamp: Restricts the numeric value to the given bounds.
+// - Map: Replaces the value using a lookup table (e.g. for enum sensors).
+type TransformStep struct {
+	Regex       string            `yaml:"regex,omitempty"`
+	StripPrefix string            `yaml:"strip_prefix,omitempty"`
+	StripSuffix string            `yaml:"strip_suffix,omitempty"`
+	Multiply    *float64          `yaml:"multiply,omitempty"`
+	Offset      *float64          `yaml:"offset,omitempty"`
+	Convert     string            `yaml:"convert,omitempty"`
+	Clamp       *ClampRange       `yaml:"clamp,omitempty"`
+	Map         map[string]string `yaml:"map,omitempty"`
+}
+
+// ClampRange represents the optional lower and upper bounds of a clamp step.
+type ClampRange struct {
+	Min *float64 `yaml:"min,omitempty"`
+	Max *float64 `yaml:"max,omitempty"`
 }
 
 // LoadConfig loads the configuration from a YAML file located at the specified file path.
@@ -86,5 +587,19 @@ func LoadConfig(filePath string) (*Config, error) {
 		return nil, fmt.Errorf("failed to decode config file: %w", err)
 	}
 
+	// Expand the sensor templates into the sensors they describe
+	sensors, err := ExpandSensorTemplates(config.Sensors)
+	if err != nil {
+		return nil, fmt.Errorf("failed to expand sensor templates: %w", err)
+	}
+	config.Sensors = sensors
+	for i, child := range config.Devices {
+		sensors, err := ExpandSensorTemplates(child.Sensors)
+		if err != nil {
+			return nil, fmt.Errorf("failed to expand sensor templates of device %q: %w", child.Name, err)
+		}
+		config.Devices[i].Sensors = sensors
+	}
+
 	return &config, nil
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// deadband decides whether a new reading of a sensor is worth publishing.
+// A reading is published when it moved at least minChange away from the last
+// published value, or when the sensor has been silent for maxSilence.
+//
+// Fields:
+// - minChange: The minimum change required to publish a new value.
+// - maxSilence: The maximum time between two publications, 0 to disable the heartbeat.
+// - lastValue: The last published value.
+// - lastTime: The time of the last publication.
+// - published: Whether a value has already been published.
+type deadband struct {
+	minChange  ChangeThreshold
+	maxSilence time.Duration
+
+	lastValue any
+	lastTime  time.Time
+	published bool
+}
+
+// newDeadband creates a deadband with the given settings.
+func newDeadband(minChange ChangeThreshold, maxSilence time.Duration) *deadband {
+	return &deadband{
+		minChange:  minChange,
+		maxSilence: maxSilence,
+	}
+}
+
+// shouldPublish reports whether value must be published at the given time.
+func (d *deadband) shouldPublish(value any, now time.Time) bool {
+	if !d.published {
+		return true
+	}
+	if d.maxSilence > 0 && now.Sub(d.lastTime) >= d.maxSilence {
+		return true
+	}
+
+	newValue, newIsNumber := value.(float64)
+	lastValue, lastIsNumber := d.lastValue.(float64)
+	if !newIsNumber || !lastIsNumber {
+		return value != d.lastValue
+	}
+
+	delta := math.Abs(newValue - lastValue)
+	if delta == 0 {
+		return false
+	}
+	threshold := d.minChange.Value
+	if d.minChange.Percent {
+		threshold = math.Abs(lastValue) * d.minChange.Value / 100
+	}
+	return delta >= threshold
+}
+
+// markPublished records value as the last published value.
+func (d *deadband) markPublished(value any, now time.Time) {
+	d.lastValue = value
+	d.lastTime = now
+	d.published = true
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	DERIVE_RATE  = "rate"
+	DERIVE_TOTAL = "total"
+
+	// DERIVE_MAX_GAP is the maximum age of a previous sample used to compute a rate.
+	// Older samples (e.g. after a long downtime) only serve as a new baseline.
+	DERIVE_MAX_GAP = 15 * time.Minute
+)
+
+// deriver turns the successive samples of a monotonically increasing counter into
+// either a per-second rate or a total which survives counter wraps and resets.
+//
+// Fields:
+// - mode: Either DERIVE_RATE or DERIVE_TOTAL.
+// - counterMax: The maximum value of the counter before it wraps, or 0 if unknown.
+// - key: The key of the counter in the state store.
+type deriver struct {
+	mode       string
+	counterMax float64
+	key        string
+}
+
+// newDeriver creates a deriver for the given mode.
+//
+// Parameters:
+//   - mode: The derive mode as declared in the configuration file.
+//   - counterMax: The maximum value of the counter before it wraps, or 0 if unknown.
+//   - key: The key used to persist the counter in the state store.
+//
+// Returns:
+//   - A pointer to the deriver.
+//   - An error if the mode is unknown.
+func newDeriver(mode string, counterMax float64, key string) (*deriver, error) {
+	if mode != DERIVE_RATE && mode != DERIVE_TOTAL {
+		return nil, fmt.Errorf("unknown derive mode %q", mode)
+	}
+	if counterMax < 0 {
+		return nil, fmt.Errorf("counter_max must not be negative")
+	}
+	return &deriver{
+		mode:       mode,
+		counterMax: counterMax,
+		key:        key,
+	}, nil
+}
+
+// apply records a new sample of the counter and returns the derived value.
+// It returns ErrNoValue when no value can be derived yet, which happens on the
+// very first sample of a rate sensor or when the previous sample is too old.
+//
+// A sample lower than the previous one is handled as a wrap when the counter
+// maximum is known and the previous sample was in the upper half of the range,
+// and as a reset otherwise, in which case the counter is assumed to have
+// restarted from zero.
+func (d *deriver) apply(store *StateStore, value float64, now time.Time) (float64, error) {
+	previous, ok := store.getCounter(d.key)
+	state := counterState{Value: value, Time: now, Total: previous.Total}
+	if !ok {
+		store.setCounter(d.key, state)
+		if d.mode == DERIVE_TOTAL {
+			return state.Total, nil
+		}
+		return 0, ErrNoValue
+	}
+
+	delta := value - previous.Value
+	if delta < 0 {
+		if d.counterMax > 0 && previous.Value > d.counterMax/2 && previous.Value <= d.counterMax {
+			// Wrap: the counter overflowed and continued from zero
+			delta = d.counterMax - previous.Value + value + 1
+		} else {
+			// Reset: the counter restarted from zero (reboot, service restart...)
+			delta = value
+		}
+	}
+	state.Total += delta
+	store.setCounter(d.key, state)
+
+	if d.mode == DERIVE_TOTAL {
+		return state.Total, nil
+	}
+
+	elapsed := now.Sub(previous.Time)
+	if elapsed <= 0 || elapsed > DERIVE_MAX_GAP {
+		return 0, ErrNoValue
+	}
+	return delta / elapsed.Seconds(), nil
+}
@@ -1,5 +1,11 @@
 package main
 
+import (
+	"context"
+	"fmt"
+	"slices"
+)
+
 // deviceConfig represents the configuration details of a device.
 // It includes the device's name, manufacturer, model, and serial number.
 type deviceConfig struct {
@@ -10,15 +16,44 @@ type deviceConfig struct {
 }
 
 // Device represents a physical or virtual device in the system.
-// It contains configuration details and a collection of associated sensors.
+// It contains configuration details, a collection of associated sensors, the
+// collectors managing dynamic sensors and the store keeping the state of its
+// stateful sensors. The revision and the removed components track the changes
+// of the sensors made by the collectors. The updates channel signals the new
+// readings of the stream sensors. The commands received for the entities of the
+// collectors wait in commands until the main loop handles them, and the requests
+// of an immediate collection in collectNow. The autodiscovery and the configured
+// sensors, whose keys are taken, are kept to enumerate the hardware again on reload.
+//
+// A device may have child devices, such as the containers or the virtual machines
+// of the host, linked to it in Home Assistant. Children are declared in the
+// configuration file with their own sensors, or created by the collectors of their
+// parent along with their entities. The parent measures its children and keeps
+// their revision, updates and commands.
 type Device struct {
-	config  *deviceConfig
-	sensors []*Sensor
+	config     *deviceConfig
+	sensors    []*Sensor
+	collectors []Collector
+	state      *StateStore
+	revision   int
+	removed    []removedComponent
+	updates    chan struct{}
+	commands   chan deviceCommand
+	collectNow chan struct{}
+
+	autodiscover *AutodiscoverConfig
+	configured   []SensorConfig
+
+	id              string
+	declared        bool
+	parent          *Device
+	children        []*Device
+	removedChildren []*Device
 }
 
 // NewDevice creates and returns a new instance of a Device with the specified
 // name, manufacturer, model, and serial number. The Device is initialized with
-// an empty list of sensors.
+// an empty list of sensors and an in-memory state store.
 //
 // Parameters:
 //   - name: The name of the device.
@@ -37,7 +72,11 @@ func NewDevice(name string, manufacturer string, model string, sn string) *Devic
 			Model:        model,
 			SerialNumber: sn,
 		},
-		sensors: []*Sensor{},
+		sensors:    []*Sensor{},
+		state:      NewStateStore(""),
+		updates:    make(chan struct{}, 1),
+		commands:   make(chan deviceCommand, COMMAND_QUEUE_SIZE),
+		collectNow: make(chan struct{}, 1),
 	}
 }
 
@@ -61,3 +100,273 @@ func (d *Device) GetDeviceInfo() *deviceConfig {
 func (d *Device) GetSensors() []*Sensor {
 	return d.sensors
 }
+
+// GetSensorByName returns the sensor of the device with the given name, or nil if
+// there is none.
+func (d *Device) GetSensorByName(name string) *Sensor {
+	for _, sensor := range d.sensors {
+		if sensor.config.Name == name {
+			return sensor
+		}
+	}
+	return nil
+}
+
+// Devices returns the device followed by its child devices.
+func (d *Device) Devices() []*Device {
+	return append([]*Device{d}, d.children...)
+}
+
+// GetParent returns the device a child device is linked to, or nil for the host.
+func (d *Device) GetParent() *Device {
+	return d.parent
+}
+
+// AddChildDevice declares a child device of the device, whose sensors are added
+// like the sensors of its parent. It lives as long as its parent.
+//
+// Parameters:
+//   - id: The identifier of the child device, unique within its parent.
+//   - name: The name of the child device.
+//   - manufacturer: The manufacturer of the child device.
+//   - model: The model of the child device.
+//
+// Returns:
+//   - A pointer to the newly created child Device instance.
+//   - An error if the identifier is empty or already used.
+func (d *Device) AddChildDevice(id string, name string, manufacturer string, model string) (*Device, error) {
+	if d.parent != nil {
+		return nil, fmt.Errorf("device %q: child devices cannot have children", d.config.Name)
+	}
+	if sensorKey(id) == "" || name == "" {
+		return nil, fmt.Errorf("child device without id or name")
+	}
+	for _, child := range d.children {
+		if sensorKey(child.id) == sensorKey(id) {
+			return nil, fmt.Errorf("child device %q: id %q is already used", name, id)
+		}
+	}
+	child, err := d.childDevice(&EntityDevice{ID: id, Name: name, Manufacturer: manufacturer, Model: model})
+	if err != nil {
+		return nil, err
+	}
+	child.declared = true
+	return child, nil
+}
+
+// childDevice returns the child device described by a collector entity, creating
+// it or updating its information when needed. Entities without device belong to
+// the device itself.
+func (d *Device) childDevice(info *EntityDevice) (*Device, error) {
+	if info == nil {
+		return d, nil
+	}
+	if d.parent != nil {
+		return nil, fmt.Errorf("device %q: child devices cannot have children", d.config.Name)
+	}
+	if info.ID == "" || info.Name == "" {
+		return nil, fmt.Errorf("child device without id or name")
+	}
+	for _, child := range d.children {
+		if child.id != info.ID {
+			continue
+		}
+		if child.config.Name != info.Name || child.config.Manufacturer != info.Manufacturer || child.config.Model != info.Model {
+			child.config.Name = info.Name
+			child.config.Manufacturer = info.Manufacturer
+			child.config.Model = info.Model
+			d.changed()
+		}
+		return child, nil
+	}
+
+	// The serial number of the host keeps the identifiers of its children unique
+	child := NewDevice(info.Name, info.Manufacturer, info.Model, d.config.SerialNumber+"_"+sensorKey(info.ID))
+	child.id = info.ID
+	child.parent = d
+	child.state = d.state
+	d.children = append(d.children, child)
+	d.removedChildren = slices.DeleteFunc(d.removedChildren, func(removed *Device) bool {
+		return removed.config.SerialNumber == child.config.SerialNumber
+	})
+	d.changed()
+	return child, nil
+}
+
+// pruneChildren removes the child devices created by collectors and left without
+// sensors.
+func (d *Device) pruneChildren() {
+	kept := d.children[:0]
+	for _, child := range d.children {
+		if !child.declared && len(child.sensors) == 0 {
+			d.removedChildren = append(d.removedChildren, child)
+			d.changed()
+			continue
+		}
+		kept = append(kept, child)
+	}
+	d.children = kept
+}
+
+// TakeRemovedChildren returns the child devices removed since the previous call,
+// whose removal must be announced to Home Assistant.
+func (d *Device) TakeRemovedChildren() []*Device {
+	removed := d.removedChildren
+	d.removedChildren = nil
+	return removed
+}
+
+// changed records a change of the components of the device. The discovery messages
+// of a device and of its children are published again together.
+func (d *Device) changed() {
+	d.root().revision++
+}
+
+// root returns the device at the top of the hierarchy, which keeps the state
+// shared with its children.
+func (d *Device) root() *Device {
+	for d.parent != nil {
+		d = d.parent
+	}
+	return d
+}
+
+// SetStateStore replaces the store keeping the state of the device's stateful sensors.
+// It is typically used to persist counters across restarts.
+func (d *Device) SetStateStore(store *StateStore) {
+	d.state = store
+}
+
+// GetStateStore returns the store keeping the state of the device's stateful sensors.
+func (d *Device) GetStateStore() *StateStore {
+	return d.state
+}
+
+// Start launches the background work of the sensors of the device and of its
+// children, such as sampling or the commands of the stream sensors.
+func (d *Device) Start() {
+	for _, sampler := range d.samplers() {
+		sampler.start()
+	}
+	for _, device := range d.Devices() {
+		for _, sensor := range device.sensors {
+			if sensor.stream != nil {
+				sensor.stream.start()
+			}
+		}
+	}
+}
+
+// Stop stops the background work of the sensors and collectors of the device and
+// of its children, and waits for it to end.
+func (d *Device) Stop() {
+	for _, sampler := range d.samplers() {
+		sampler.halt()
+	}
+	for _, device := range d.Devices() {
+		for _, sensor := range device.sensors {
+			if sensor.stream != nil {
+				sensor.stream.halt()
+			}
+		}
+		for _, collector := range device.collectors {
+			if stoppable, ok := collector.(interface{ Stop() }); ok {
+				stoppable.Stop()
+			}
+		}
+	}
+}
+
+// samplers returns the distinct samplers used by the sensors of the device and
+// of its children.
+func (d *Device) samplers() []*sampler {
+	var samplers []*sampler
+	for _, device := range d.Devices() {
+		for _, sensor := range device.sensors {
+			if sensor.sampler != nil && !slices.Contains(samplers, sensor.sampler) {
+				samplers = append(samplers, sensor.sampler)
+			}
+		}
+	}
+	return samplers
+}
+
+// Collect measures every sensor of the device and of its children once and returns
+// the resulting snapshot. Collectors are polled after the other sensors and may add
+// or remove sensors and child devices. The state of the stateful sensors is saved
+// once all the sensors have been measured.
+//
+// Parameters:
+//   - ctx: Stops the commands and the requests of the sensors when cancelled.
+//
+// Returns:
+//   - *Snapshot: The readings of every sensor.
+//   - error: An error if the state store cannot be saved; the snapshot is still valid.
+func (d *Device) Collect(ctx context.Context) (*Snapshot, error) {
+	// Close the window of every sampler once, before its sensors read it
+	for _, sampler := range d.samplers() {
+		sampler.roll()
+	}
+
+	snapshot := NewSnapshot()
+	// The collectors below may add or remove children, only the current ones are measured
+	devices := d.Devices()
+	for _, device := range devices {
+		readings := snapshot.Of(device).Readings
+		for _, sensor := range device.sensors {
+			if sensor.collector != nil {
+				continue
+			}
+			readings[sensor.Key()] = sensor.Measure(ctx)
+		}
+	}
+	for _, device := range devices {
+		for _, collector := range device.collectors {
+			device.collectFrom(ctx, collector, snapshot)
+		}
+	}
+	if err := d.state.Save(); err != nil {
+		return snapshot, err
+	}
+	return snapshot, nil
+}
+
+// RequestCollection asks the main loop to start the next cycle without waiting for
+// the refresh period. It never blocks, requests made while one is pending are merged.
+func (d *Device) RequestCollection() {
+	select {
+	case d.root().collectNow <- struct{}{}:
+	default:
+	}
+}
+
+// CollectionRequests returns a channel receiving a value when an immediate
+// collection is requested.
+func (d *Device) CollectionRequests() <-chan struct{} {
+	return d.collectNow
+}
+
+// FilterPublishable returns a snapshot holding only the readings of the given
+// snapshot which must be published, according to the deadband of their sensors.
+func (d *Device) FilterPublishable(snapshot *Snapshot) *Snapshot {
+	filtered := &Snapshot{
+		Time:     snapshot.Time,
+		Readings: map[string]Reading{},
+	}
+	for _, sensor := range d.sensors {
+		reading, ok := snapshot.Readings[sensor.Key()]
+		if ok && sensor.ShouldPublish(reading) {
+			filtered.Readings[sensor.Key()] = reading
+		}
+	}
+	return filtered
+}
+
+// MarkPublished records every reading of the snapshot as published by its sensor.
+func (d *Device) MarkPublished(snapshot *Snapshot) {
+	for _, sensor := range d.sensors {
+		if reading, ok := snapshot.Readings[sensor.Key()]; ok {
+			sensor.MarkPublished(reading)
+		}
+	}
+}
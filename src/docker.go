@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_DOCKER_SOCKET = "/var/run/docker.sock"
+
+	// DOCKER_API_TIMEOUT is the time the Docker Engine is given to answer a query.
+	DOCKER_API_TIMEOUT = 10 * time.Second
+	// DOCKER_ACTION_TIMEOUT is the time a container is given to start, stop or
+	// restart, longer than the 10 seconds Docker waits before killing a container.
+	DOCKER_ACTION_TIMEOUT = time.Minute
+)
+
+// dockerActions maps the buttons of a container to the actions of the Docker Engine API.
+var dockerActions = map[string]string{
+	"Start":   "start",
+	"Stop":    "stop",
+	"Restart": "restart",
+}
+
+// dockerClient is a minimal client of the Docker Engine API, reached over its unix socket.
+type dockerClient struct {
+	http *http.Client
+}
+
+// dockerError represents an error answered by the Docker Engine API.
+type dockerError struct {
+	status  int
+	message string
+}
+
+func (e *dockerError) Error() string {
+	return fmt.Sprintf("docker: %s (HTTP %d)", e.message, e.status)
+}
+
+// dockerContainer represents a container listed by the Docker Engine API.
+type dockerContainer struct {
+	ID     string   `json:"Id"`
+	Names  []string `json:"Names"`
+	Image  string   `json:"Image"`
+	State  string   `json:"State"`
+	Status string   `json:"Status"`
+}
+
+// dockerInspect represents the part of the details of a container used by the agent.
+type dockerInspect struct {
+	RestartCount int `json:"RestartCount"`
+	State        struct {
+		Status string `json:"Status"`
+		Health *struct {
+			Status string `json:"Status"`
+		} `json:"Health"`
+	} `json:"State"`
+}
+
+// dockerStats represents the part of the resource usage of a container used by the agent.
+type dockerStats struct {
+	CPUStats struct {
+		CPUUsage struct {
+			TotalUsage  uint64   `json:"total_usage"`
+			PercpuUsage []uint64 `json:"percpu_usage"`
+		} `json:"cpu_usage"`
+		SystemUsage uint64 `json:"system_cpu_usage"`
+		OnlineCPUs  int    `json:"online_cpus"`
+	} `json:"cpu_stats"`
+	MemoryStats struct {
+		Usage uint64            `json:"usage"`
+		Stats map[string]uint64 `json:"stats"`
+	} `json:"memory_stats"`
+}
+
+// dockerCPUSample represents the CPU time consumed by a container and by the
+// whole host, in nanoseconds, at a collection.
+type dockerCPUSample struct {
+	container uint64
+	system    uint64
+}
+
+// DockerMonitor is a Collector publishing the containers of the Docker Engine as
+// child devices of the host: their state, health, restart count, CPU usage and
+// memory, and optionally buttons starting, stopping and restarting them. The
+// devices of the containers are created and removed as the containers come and go.
+//
+// Fields:
+// - client: The client of the Docker Engine API.
+// - include: The glob patterns of the names of the monitored containers.
+// - exclude: The glob patterns of the names of the skipped containers.
+// - buttons: Whether the buttons of the containers are published.
+// - lastCPU: The CPU time of every running container at the previous collection.
+// - containers: The ID of the container of every child device, for the buttons.
+type DockerMonitor struct {
+	client  *dockerClient
+	include []string
+	exclude []string
+	buttons bool
+
+	lastCPU    map[string]dockerCPUSample
+	containers map[string]string
+}
+
+// NewDockerMonitor creates a new Docker collector from its configuration file section.
+//
+// Parameters:
+//   - cfg: The docker section of the configuration file.
+//
+// Returns:
+//   - A pointer to the newly created DockerMonitor instance.
+//   - An error if a pattern is invalid.
+func NewDockerMonitor(cfg DockerConfig) (*DockerMonitor, error) {
+	for _, pattern := range append(append([]string{}, cfg.Include...), cfg.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("docker: invalid pattern %q: %w", pattern, err)
+		}
+	}
+	socket := cfg.Socket
+	if socket == "" {
+		socket = DEFAULT_DOCKER_SOCKET
+	}
+	return &DockerMonitor{
+		client:  newDockerClient(socket),
+		include: cfg.Include,
+		exclude: cfg.Exclude,
+		buttons: cfg.Buttons,
+	}, nil
+}
+
+// Name returns the name of the collector.
+func (m *DockerMonitor) Name() string {
+	return "docker"
+}
+
+// Collect lists the containers and returns the entities of the monitored ones. The
+// CPU usage is the share of the host used since the previous collection, times the
+// number of cores like `docker stats`; it is unknown at the first collection.
+func (m *DockerMonitor) Collect(ctx context.Context) ([]CollectedEntity, error) {
+	var containers []dockerContainer
+	if err := m.client.request(ctx, http.MethodGet, "/containers/json?all=true", DOCKER_API_TIMEOUT, &containers); err != nil {
+		return nil, err
+	}
+
+	var entities []CollectedEntity
+	samples := map[string]dockerCPUSample{}
+	m.containers = map[string]string{}
+	for _, container := range containers {
+		name := container.ID
+		if len(container.Names) > 0 {
+			name = strings.TrimPrefix(container.Names[0], "/")
+		}
+		if !matchesGlobs(name, m.include, m.exclude) {
+			continue
+		}
+		containerEntities, err := m.collectContainer(ctx, container, name, samples)
+		var apiErr *dockerError
+		if errors.As(err, &apiErr) && apiErr.status == http.StatusNotFound {
+			// The container was removed since it was listed
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entities = append(entities, containerEntities...)
+	}
+	m.lastCPU = samples
+	return entities, nil
+}
+
+// collectContainer returns the entities of a single container, and records its
+// CPU time in samples.
+func (m *DockerMonitor) collectContainer(ctx context.Context, container dockerContainer, name string, samples map[string]dockerCPUSample) ([]CollectedEntity, error) {
+	var inspect dockerInspect
+	if err := m.client.request(ctx, http.MethodGet, "/containers/"+container.ID+"/json", DOCKER_API_TIMEOUT, &inspect); err != nil {
+		return nil, err
+	}
+
+	// Stopped containers use no resources
+	var cpu, memory any = 0.0, 0.0
+	if inspect.State.Status == "running" {
+		var stats dockerStats
+		if err := m.client.request(ctx, http.MethodGet, "/containers/"+container.ID+"/stats?stream=false&one-shot=true", DOCKER_API_TIMEOUT, &stats); err != nil {
+			return nil, err
+		}
+		sample := dockerCPUSample{container: stats.CPUStats.CPUUsage.TotalUsage, system: stats.CPUStats.SystemUsage}
+		samples[container.ID] = sample
+		cpu = nil
+		if previous, ok := m.lastCPU[container.ID]; ok && sample.system > previous.system && sample.container >= previous.container {
+			cpus := stats.CPUStats.OnlineCPUs
+			if cpus == 0 {
+				cpus = max(len(stats.CPUStats.CPUUsage.PercpuUsage), 1)
+			}
+			cpu = float64(sample.container-previous.container) / float64(sample.system-previous.system) * float64(cpus) * 100
+		}
+		memory = float64(containerMemory(stats)) / (1 << 20)
+	}
+
+	deviceID := "docker_" + name
+	m.containers[deviceID] = container.ID
+	device := &EntityDevice{ID: deviceID, Name: name, Manufacturer: "Docker", Model: container.Image}
+	entities := []CollectedEntity{
+		{
+			Name:        "State",
+			DeviceClass: "enum",
+			Icon:        "mdi:docker",
+			Value:       inspect.State.Status,
+			Attributes: map[string]any{
+				"id":     container.ID[:min(12, len(container.ID))],
+				"image":  container.Image,
+				"status": container.Status,
+			},
+			Device: device,
+		},
+		{Name: "Restarts", StateClass: "total_increasing", Icon: "mdi:restart", Value: float64(inspect.RestartCount), Device: device},
+		{Name: "CPU", StateClass: "measurement", Unit: "%", Icon: "mdi:cpu-64-bit", Value: cpu, Device: device},
+		{Name: "Memory", DeviceClass: "data_size", StateClass: "measurement", Unit: "MiB", Value: memory, Device: device},
+	}
+	// Only containers with a health check have a health
+	if inspect.State.Health != nil {
+		entities = append(entities, CollectedEntity{
+			Name:        "Health",
+			DeviceClass: "enum",
+			Icon:        "mdi:heart-pulse",
+			Value:       inspect.State.Health.Status,
+			Device:      device,
+		})
+	}
+	if m.buttons {
+		entities = append(entities,
+			CollectedEntity{Name: "Start", Platform: PLATFORM_BUTTON, Icon: "mdi:play", Device: device},
+			CollectedEntity{Name: "Stop", Platform: PLATFORM_BUTTON, Icon: "mdi:stop", Device: device},
+			CollectedEntity{Name: "Restart", Platform: PLATFORM_BUTTON, DeviceClass: "restart", Device: device},
+		)
+	}
+	return entities, nil
+}
+
+// Command starts, stops or restarts a container when its button is pressed.
+func (m *DockerMonitor) Command(ctx context.Context, device string, entity string, payload string) error {
+	id, ok := m.containers[device]
+	if !ok {
+		return fmt.Errorf("unknown container %q", device)
+	}
+	action, ok := dockerActions[entity]
+	if !ok {
+		return fmt.Errorf("unknown container action %q", entity)
+	}
+	return m.client.request(ctx, http.MethodPost, "/containers/"+id+"/"+action, DOCKER_ACTION_TIMEOUT, nil)
+}
+
+// containerMemory returns the memory used by a container, without the inactive
+// page cache which the kernel reclaims first, like `docker stats`.
+func containerMemory(stats dockerStats) uint64 {
+	memory := stats.MemoryStats
+	// cgroup v1 reports the cache of the hierarchy, cgroup v2 of the container
+	if inactive, ok := memory.Stats["total_inactive_file"]; ok && inactive < memory.Usage {
+		return memory.Usage - inactive
+	}
+	if inactive := memory.Stats["inactive_file"]; inactive < memory.Usage {
+		return memory.Usage - inactive
+	}
+	return memory.Usage
+}
+
+// newDockerClient creates a client of the Docker Engine API listening on the socket.
+func newDockerClient(socket string) *dockerClient {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+	}
+	return &dockerClient{http: &http.Client{Transport: transport}}
+}
+
+// request sends a request to the Docker Engine API and decodes its JSON answer
+// into result, unless it is nil. Actions on a container already in the requested
+// state succeed.
+func (c *dockerClient) request(ctx context.Context, method string, path string, timeout time.Duration, result any) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// The host is ignored, the connection goes through the socket
+	req, err := http.NewRequestWithContext(ctx, method, "http://docker"+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("docker: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if resp.StatusCode >= 300 {
+		var answer struct {
+			Message string `json:"message"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&answer) != nil || answer.Message == "" {
+			answer.Message = resp.Status
+		}
+		return &dockerError{status: resp.StatusCode, message: answer.Message}
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("docker: invalid answer to %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	dockerWebID = "3f4c2b1a9e8d7c6b5a4f3e2d1c0b9a8f7e6d5c4b3a2f1e0d9c8b7a6f5e4d3c2b"
+	dockerDBID  = "a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f90"
+)
+
+// dockerResponses are the answers of the fake Docker Engine, trimmed to the fields
+// read by the agent, for a running nginx container and a stopped postgres one.
+var dockerResponses = map[string]string{
+	"/containers/" + dockerWebID + "/json": `{"Id":"` + dockerWebID + `","Name":"/web","RestartCount":2,
+		"State":{"Status":"running","Running":true,"Health":{"Status":"healthy","FailingStreak":0}}}`,
+	"/containers/" + dockerWebID + "/stats": `{"read":"2025-06-01T10:00:00.000000000Z",
+		"cpu_stats":{"cpu_usage":{"total_usage":2000000000},"system_cpu_usage":400000000000,"online_cpus":4},
+		"memory_stats":{"usage":73400320,"stats":{"inactive_file":10485760}}}`,
+	"/containers/" + dockerDBID + "/json": `{"Id":"` + dockerDBID + `","Name":"/db","RestartCount":0,
+		"State":{"Status":"exited","Running":false,"ExitCode":0}}`,
+}
+
+// dockerContainerList returns the answer of /containers/json for the given containers.
+func dockerContainerList(ids ...string) string {
+	containers := map[string]string{
+		dockerWebID: `{"Id":"` + dockerWebID + `","Names":["/web"],"Image":"nginx:1.27","State":"running","Status":"Up 3 hours (healthy)"}`,
+		dockerDBID:  `{"Id":"` + dockerDBID + `","Names":["/db"],"Image":"postgres:16","State":"exited","Status":"Exited (0) 2 days ago"}`,
+	}
+	var list []string
+	for _, id := range ids {
+		list = append(list, containers[id])
+	}
+	return "[" + strings.Join(list, ",") + "]"
+}
+
+// fakeDockerEngine serves the canned answers of the Docker Engine API on a unix
+// socket, listing the containers set with setContainers.
+type fakeDockerEngine struct {
+	socket     string
+	mu         sync.Mutex
+	containers string
+}
+
+func newFakeDockerEngine(t *testing.T) *fakeDockerEngine {
+	engine := &fakeDockerEngine{socket: filepath.Join(t.TempDir(), "docker.sock")}
+	listener, err := net.Listen("unix", engine.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/containers/json" {
+			engine.mu.Lock()
+			defer engine.mu.Unlock()
+			w.Write([]byte(engine.containers))
+			return
+		}
+		answer, ok := dockerResponses[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"No such container"}`))
+			return
+		}
+		w.Write([]byte(answer))
+	}))
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+	return engine
+}
+
+func (e *fakeDockerEngine) setContainers(ids ...string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.containers = dockerContainerList(ids...)
+}
+
+// fakeMQTTClient records the last payload published on every topic, and the
+// topics subscribed.
+type fakeMQTTClient struct {
+	mqtt.Client
+	published  map[string]string
+	subscribed map[string]bool
+}
+
+func (c *fakeMQTTClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.published[topic] = payload.(string)
+	return completedToken{}
+}
+
+func (c *fakeMQTTClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.subscribed[topic] = true
+	return completedToken{}
+}
+
+func (c *fakeMQTTClient) Unsubscribe(topics ...string) mqtt.Token {
+	for _, topic := range topics {
+		delete(c.subscribed, topic)
+	}
+	return completedToken{}
+}
+
+// completedToken is a successful token of the fake MQTT client.
+type completedToken struct{}
+
+func (completedToken) Wait() bool                     { return true }
+func (completedToken) WaitTimeout(time.Duration) bool { return true }
+func (completedToken) Error() error                   { return nil }
+func (completedToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+// newDockerTestDevice returns a host device monitoring the fake Docker Engine.
+func newDockerTestDevice(t *testing.T, engine *fakeDockerEngine) *Device {
+	monitor, err := NewDockerMonitor(DockerConfig{Socket: engine.socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := NewDevice("Host", "Manufacturer", "Model", "host-sn")
+	device.AddCollector(monitor)
+	return device
+}
+
+// dockerChild returns the child device of the container with the given name.
+func dockerChild(device *Device, name string) *Device {
+	for _, child := range device.Devices()[1:] {
+		if child.GetDeviceInfo().Name == name {
+			return child
+		}
+	}
+	return nil
+}
+
+func TestDockerMonitorChildDevices(t *testing.T) {
+	engine := newFakeDockerEngine(t)
+	engine.setContainers(dockerWebID, dockerDBID)
+	device := newDockerTestDevice(t, engine)
+
+	snapshot, err := device.Collect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(device.Devices()); got != 3 {
+		t.Fatalf("%d devices, want the host and 2 containers", got)
+	}
+
+	web := dockerChild(device, "web")
+	if web == nil {
+		t.Fatal("no device for the web container")
+	}
+	if got := web.GetDeviceInfo().Model; got != "nginx:1.27" {
+		t.Errorf("model = %q, want the image", got)
+	}
+	config, err := FormatMQTTConfig(web)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var discovery autoDiscoveryDeviceMQTT
+	if err := json.Unmarshal([]byte(config), &discovery); err != nil {
+		t.Fatal(err)
+	}
+	if discovery.Device.ViaDevice != "host-sn" {
+		t.Errorf("via_device = %q, want the serial number of the host", discovery.Device.ViaDevice)
+	}
+	for _, key := range []string{"state", "restarts", "cpu", "memory", "health"} {
+		if _, ok := discovery.Components[key]; !ok {
+			t.Errorf("no %q component in %s", key, config)
+		}
+	}
+
+	readings := snapshot.Of(web).Readings
+	if got := readings["state"].Value; got != "running" {
+		t.Errorf("state = %v, want running", got)
+	}
+	if got := readings["health"].Value; got != "healthy" {
+		t.Errorf("health = %v, want healthy", got)
+	}
+	if got := readings["restarts"].Value; got != 2.0 {
+		t.Errorf("restarts = %v, want 2", got)
+	}
+	// The inactive page cache is not counted
+	if got := readings["memory"].Value; got != 60.0 {
+		t.Errorf("memory = %v MiB, want 60", got)
+	}
+
+	db := dockerChild(device, "db")
+	if db == nil {
+		t.Fatal("no device for the db container")
+	}
+	if got := snapshot.Of(db).Readings["state"].Value; got != "exited" {
+		t.Errorf("state = %v, want exited", got)
+	}
+	if _, ok := snapshot.Of(db).Readings["health"]; ok {
+		t.Error("container without health check has a health")
+	}
+}
+
+func TestDockerMonitorRemovedContainer(t *testing.T) {
+	engine := newFakeDockerEngine(t)
+	engine.setContainers(dockerWebID, dockerDBID)
+	device := newDockerTestDevice(t, engine)
+	client := &fakeMQTTClient{published: map[string]string{}, subscribed: map[string]bool{}}
+	proxy := NewMQTTProxy("127.0.0.1", "1883", "", "")
+	proxy.client = client
+	proxy.connected.Store(true)
+	sink := NewMQTTSink(proxy)
+
+	snapshot, err := device.Collect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Publish(context.Background(), device, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	db := dockerChild(device, "db")
+	if db == nil {
+		t.Fatal("no device for the db container")
+	}
+	if !client.subscribed[GetCommandSubscription(db)] {
+		t.Errorf("commands of the db container not subscribed, subscribed %v", client.subscribed)
+	}
+
+	engine.setContainers(dockerWebID)
+	snapshot, err = device.Collect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dockerChild(device, "db") != nil {
+		t.Fatal("the device of the removed container is kept")
+	}
+
+	if err := sink.Publish(context.Background(), device, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	payload, ok := client.published[GetConfigTopic(db)]
+	if !ok || payload != "" {
+		t.Errorf("config of the removed container = %q (published %v), want an empty payload", payload, ok)
+	}
+	if client.published[GetConfigTopic(dockerChild(device, "web"))] == "" {
+		t.Error("config of the remaining container not published")
+	}
+
+	// Only the commands of the host and of its containers are received
+	want := map[string]bool{
+		GetCommandSubscription(device):                     true,
+		GetCommandSubscription(dockerChild(device, "web")): true,
+	}
+	if !reflect.DeepEqual(client.subscribed, want) {
+		t.Errorf("subscribed %v, want %v", client.subscribed, want)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_METRICS_PATH = "/metrics"
+
+	// METRICS_PREFIX prefixes the names of the metrics of the sensors. The metrics
+	// of the agent itself are prefixed with METRICS_PREFIX + "agent_".
+	METRICS_PREFIX = "penguinhomelink_"
+)
+
+// invalidMetricPattern matches the characters not allowed in a Prometheus metric name.
+var invalidMetricPattern = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// metricSample represents a single line of the exposition format.
+type metricSample struct {
+	labels string
+	value  float64
+}
+
+// metricFamily represents the samples of a metric, with their help and type.
+type metricFamily struct {
+	help    string
+	kind    string
+	samples []metricSample
+}
+
+// PrometheusExporter is an HTTP listener exposing the latest readings of the
+// sensors of the device and of its children in the Prometheus exposition format,
+// along with metrics of the agent itself. It is updated by the main loop after
+// every collection, whether the MQTT server is reachable or not.
+//
+// Fields:
+// - localServer: The HTTP server.
+// - path: The path of the metrics.
+// - readings: The last reading of every sensor, for the partial snapshots of the stream sensors.
+// - mu: Guards the fields below, read by the HTTP server.
+// - sensorMetrics: The metrics of the sensors, rendered by the last update.
+// - cycles: The number of collection cycles since the agent started.
+// - lastCycle: The time of the last collection cycle.
+// - cycleDuration: The time taken by the last collection cycle.
+// - sensorErrors: The number of sensors whose last reading failed.
+// - sinksUp: Whether the last publication to every sink succeeded.
+type PrometheusExporter struct {
+	*localServer
+	path     string
+	readings map[*Sensor]Reading
+
+	mu            sync.Mutex
+	sensorMetrics string
+	cycles        int
+	lastCycle     time.Time
+	cycleDuration time.Duration
+	sensorErrors  int
+	sinksUp       map[string]bool
+}
+
+// NewPrometheusExporter creates the exporter and binds its listener, so that an
+// address already in use is reported at startup. It serves nothing until Start.
+//
+// Parameters:
+//   - cfg: The prometheus_exporter section of the configuration file.
+//
+// Returns:
+//   - A pointer to the newly created PrometheusExporter instance.
+//   - An error if the address is missing or cannot be bound.
+func NewPrometheusExporter(cfg PrometheusExporterConfig) (*PrometheusExporter, error) {
+	path := cfg.Path
+	if path == "" {
+		path = DEFAULT_METRICS_PATH
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("prometheus_exporter: path %q must start with /", path)
+	}
+
+	exporter := &PrometheusExporter{
+		path:     path,
+		readings: map[*Sensor]Reading{},
+		sinksUp:  map[string]bool{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, exporter.serveMetrics)
+	server, err := newLocalServer("prometheus_exporter", cfg.Listen, mux)
+	if err != nil {
+		return nil, err
+	}
+	exporter.localServer = server
+	return exporter, nil
+}
+
+// Update records the readings of a snapshot of the device and renders the metrics
+// of its sensors. Partial snapshots, such as those of the stream sensors, only
+// replace the readings they hold.
+func (e *PrometheusExporter) Update(device *Device, snapshot *Snapshot) {
+	readings := mergeReadings(device, snapshot, e.readings)
+	failed := 0
+	for _, reading := range readings {
+		if reading.Err != nil && !errors.Is(reading.Err, ErrNoValue) {
+			failed++
+		}
+	}
+	e.readings = readings
+	rendered := renderSensorMetrics(device, readings)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.sensorMetrics = rendered
+	e.sensorErrors = failed
+}
+
+// RecordCycle records the end of a collection cycle.
+func (e *PrometheusExporter) RecordCycle(start time.Time, duration time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.cycles++
+	e.lastCycle = start
+	e.cycleDuration = duration
+}
+
+// SetSinkStatus records the result of the last publication to a sink.
+func (e *PrometheusExporter) SetSinkStatus(sink Sink, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.sinksUp[sink.Name()] = err == nil
+}
+
+// serveMetrics answers the scrapes of Prometheus.
+func (e *PrometheusExporter) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	lastCycle := 0.0
+	if !e.lastCycle.IsZero() {
+		lastCycle = float64(e.lastCycle.UnixMilli()) / 1000
+	}
+	agent := map[string]*metricFamily{
+		"agent_build_info": {
+			help:    "Version of the agent.",
+			kind:    "gauge",
+			samples: []metricSample{{labels: formatLabels([][2]string{{"version", SOFTWARE_VERSION}}), value: 1}},
+		},
+		"agent_cycles_total": {
+			help:    "Number of collection cycles since the agent started.",
+			kind:    "counter",
+			samples: []metricSample{{value: float64(e.cycles)}},
+		},
+		"agent_last_cycle_timestamp_seconds": {
+			help:    "Time of the last collection cycle.",
+			kind:    "gauge",
+			samples: []metricSample{{value: lastCycle}},
+		},
+		"agent_cycle_duration_seconds": {
+			help:    "Time taken by the last collection cycle.",
+			kind:    "gauge",
+			samples: []metricSample{{value: e.cycleDuration.Seconds()}},
+		},
+		"agent_sensor_errors": {
+			help:    "Number of sensors whose last reading failed.",
+			kind:    "gauge",
+			samples: []metricSample{{value: float64(e.sensorErrors)}},
+		},
+		"agent_sink_up": {
+			help: "Whether the last publication to the sink succeeded.",
+			kind: "gauge",
+		},
+	}
+	sinks := make([]string, 0, len(e.sinksUp))
+	for sink := range e.sinksUp {
+		sinks = append(sinks, sink)
+	}
+	sort.Strings(sinks)
+	for _, sink := range sinks {
+		agent["agent_sink_up"].samples = append(agent["agent_sink_up"].samples, metricSample{
+			labels: formatLabels([][2]string{{"sink", sink}}),
+			value:  boolToFloat(e.sinksUp[sink]),
+		})
+	}
+	sensorMetrics := e.sensorMetrics
+	e.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprint(w, renderFamilies(agent))
+	fmt.Fprint(w, sensorMetrics)
+}
+
+// renderSensorMetrics renders the readings of the sensors in the exposition format.
+// Numbers and binary states are exposed as is, enum states as a sample valued 1
+// labelled with the state. Sensors without a value are left out.
+func renderSensorMetrics(device *Device, readings map[*Sensor]Reading) string {
+	families := map[string]*metricFamily{}
+	for _, dev := range device.Devices() {
+		for _, sensor := range dev.GetSensors() {
+			reading, ok := readings[sensor]
+			if !ok || reading.Err != nil {
+				continue
+			}
+			name, kind := metricName(sensor)
+			labels := [][2]string{
+				{"serial", dev.GetDeviceInfo().SerialNumber},
+				{"device", dev.GetDeviceInfo().Name},
+				{"unit", sensor.config.UnitOfMeasurement},
+				{"device_class", sensor.config.DeviceClass},
+			}
+			var value float64
+			switch v := reading.Value.(type) {
+			case float64:
+				value = v
+			case string:
+				if sensor.IsBinary() {
+					value = boolToFloat(v == BINARY_ON)
+				} else {
+					labels = append(labels, [2]string{"state", v})
+					value = 1
+				}
+			default:
+				continue
+			}
+
+			// Sensors of several devices share a family when they share a name
+			family, ok := families[name]
+			if !ok {
+				family = &metricFamily{help: sensor.config.Name, kind: kind}
+				families[name] = family
+			}
+			family.samples = append(family.samples, metricSample{labels: formatLabels(labels), value: value})
+		}
+	}
+	return renderFamilies(families)
+}
+
+// metricName returns the name and the type of the metric of a sensor, derived
+// from its snake_case key. Totals are counters, the other sensors are gauges.
+func metricName(sensor *Sensor) (string, string) {
+	name := strings.Trim(invalidMetricPattern.ReplaceAllString(sensor.Key(), "_"), "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	if sensor.config.StateClass == "total" || sensor.config.StateClass == "total_increasing" {
+		if !strings.HasSuffix(name, "_total") {
+			name += "_total"
+		}
+		return name, "counter"
+	}
+	return name, "gauge"
+}
+
+// renderFamilies renders metric families in the exposition format, sorted by name.
+func renderFamilies(families map[string]*metricFamily) string {
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var builder strings.Builder
+	for _, name := range names {
+		family := families[name]
+		fullName := METRICS_PREFIX + name
+		fmt.Fprintf(&builder, "# HELP %s %s\n", fullName, escapeHelp(family.help))
+		fmt.Fprintf(&builder, "# TYPE %s %s\n", fullName, family.kind)
+		for _, sample := range family.samples {
+			fmt.Fprintf(&builder, "%s%s %s\n", fullName, sample.labels, strconv.FormatFloat(sample.value, 'g', -1, 64))
+		}
+	}
+	return builder.String()
+}
+
+// formatLabels renders a label set, in the given order.
+func formatLabels(labels [][2]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(labels))
+	for _, label := range labels {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(label[1])
+		parts = append(parts, label[0]+`="`+value+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// escapeHelp escapes the help text of a metric.
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+// boolToFloat converts a boolean to 1 or 0.
+func boolToFloat(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
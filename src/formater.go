@@ -2,10 +2,6 @@ package main
 
 import (
 	"encoding/json"
-	"math"
-	"strconv"
-
-	"github.com/iancoleman/strcase"
 )
 
 // component represents a structure used to define metadata for a specific component.
@@ -17,18 +13,33 @@ import (
 // - Platform: The platform associated with the component.
 // - DeviceClass: The class of the device, used to categorize the component.
 // - UnitOfMeasurement: The unit of measurement for the component's value.
+// - StateClass: The state class of the component (e.g. measurement, total_increasing).
 // - ValueTemplate: A template used to format the value of the component.
 // - UniqueID: A unique identifier for the component.
 // - StateTopic: The MQTT topic where the component's state is published.
+// - Icon: The icon of the component.
+// - ExpireAfter: The time in seconds after which the component becomes unavailable.
+// - PayloadOn: The payload meaning on, for binary sensors.
+// - PayloadOff: The payload meaning off, for binary sensors.
+// - AttributesTopic: The MQTT topic where the component's attributes are published.
+// - EventTypes: The types of the events fired by an event component.
+// - CommandTopic: The MQTT topic where the presses of a button are sent.
 type component struct {
-	Name              string `json:"name"`
-	Platform          string `json:"platform"`
-	DeviceClass       string `json:"device_class"`
-	UnitOfMeasurement string `json:"unit_of_measurement"`
-	ValueTemplate     string `json:"value_template"`
-	UniqueID          string `json:"unique_id"`
-	StateTopic        string `json:"state_topic"`
-	Icon              string `json:"icon,omitempty"`
+	Name              string   `json:"name,omitempty"`
+	Platform          string   `json:"platform"`
+	DeviceClass       string   `json:"device_class,omitempty"`
+	UnitOfMeasurement string   `json:"unit_of_measurement,omitempty"`
+	StateClass        string   `json:"state_class,omitempty"`
+	ValueTemplate     string   `json:"value_template,omitempty"`
+	UniqueID          string   `json:"unique_id,omitempty"`
+	StateTopic        string   `json:"state_topic,omitempty"`
+	Icon              string   `json:"icon,omitempty"`
+	ExpireAfter       int      `json:"expire_after,omitempty"`
+	PayloadOn         string   `json:"payload_on,omitempty"`
+	PayloadOff        string   `json:"payload_off,omitempty"`
+	AttributesTopic   string   `json:"json_attributes_topic,omitempty"`
+	EventTypes        []string `json:"event_types,omitempty"`
+	CommandTopic      string   `json:"command_topic,omitempty"`
 }
 
 // autoDiscoveryDeviceMQTT represents the structure for an MQTT auto-discovery device.
@@ -42,6 +53,7 @@ type component struct {
 //	  - Manufacturer: The manufacturer of the device.
 //	  - Model: The model of the device.
 //	  - SerialNumber: The serial number of the device.
+//	  - ViaDevice: The identifier of the parent of a child device.
 //
 //	Origin:
 //	  - Name: The name of the origin source.
@@ -54,6 +66,9 @@ type component struct {
 //	StateTopic:
 //	  - The MQTT topic where the device's state is published.
 //
+//	AvailabilityTopic:
+//	  - The MQTT topic telling whether the agent is online, shared by the device and its children.
+//
 //	QoS:
 //	  - The Quality of Service (QoS) level for MQTT communication.
 type autoDiscoveryDeviceMQTT struct {
@@ -63,20 +78,24 @@ type autoDiscoveryDeviceMQTT struct {
 		Manufacturer string   `json:"manufacturer"`
 		Model        string   `json:"model"`
 		SerialNumber string   `json:"serial_number"`
+		ViaDevice    string   `json:"via_device,omitempty"`
 	} `json:"device"`
 	Origin struct {
 		Name string `json:"name"`
 		Sw   string `json:"sw"`
 		Url  string `json:"url"`
 	} `json:"o"`
-	Components map[string]component `json:"cmps"`
-	StateTopic string               `json:"state_topic"`
-	QoS        int                  `json:"qos"`
+	Components        map[string]component `json:"cmps"`
+	StateTopic        string               `json:"state_topic"`
+	AvailabilityTopic string               `json:"availability_topic"`
+	QoS               int                  `json:"qos"`
 }
 
 // FormatMQTTConfig formats the MQTT configuration for a given device into a JSON string.
 // It creates an auto-discovery MQTT structure containing device information, origin details,
-// and sensor components.
+// and sensor components. Components removed from the device are announced with their
+// platform only, which removes them from Home Assistant. Child devices are linked
+// to their parent with via_device.
 //
 // Parameters:
 //   - device: A pointer to a Device object containing the device and sensor information.
@@ -87,8 +106,9 @@ type autoDiscoveryDeviceMQTT struct {
 func FormatMQTTConfig(device *Device) (string, error) {
 	// Create the auto discovery device MQTT structure
 	autoDiscoveryDevice := autoDiscoveryDeviceMQTT{
-		StateTopic: device.GetDeviceInfo().SerialNumber,
-		QoS:        1,
+		StateTopic:        device.GetDeviceInfo().SerialNumber,
+		AvailabilityTopic: GetAvailabilityTopic(device),
+		QoS:               1,
 	}
 
 	// Fill the device information
@@ -97,6 +117,9 @@ func FormatMQTTConfig(device *Device) (string, error) {
 	autoDiscoveryDevice.Device.Manufacturer = device.GetDeviceInfo().Manufacturer
 	autoDiscoveryDevice.Device.Model = device.GetDeviceInfo().Model
 	autoDiscoveryDevice.Device.SerialNumber = device.GetDeviceInfo().SerialNumber
+	if parent := device.GetParent(); parent != nil {
+		autoDiscoveryDevice.Device.ViaDevice = parent.GetDeviceInfo().SerialNumber
+	}
 
 	// Fill the origin information
 	autoDiscoveryDevice.Origin.Name = SOFTWARE_NAME
@@ -109,15 +132,38 @@ func FormatMQTTConfig(device *Device) (string, error) {
 	for _, sensor := range device.GetSensors() {
 		component := component{
 			Name:              sensor.config.Name,
-			Platform:          "sensor",
+			Platform:          sensor.config.Platform,
 			DeviceClass:       sensor.config.DeviceClass,
 			UnitOfMeasurement: sensor.config.UnitOfMeasurement,
-			ValueTemplate:     "{{ value_json." + strcase.ToSnake(sensor.config.Name) + " }}",
-			UniqueID:          sensor.config.Name + "_" + device.GetDeviceInfo().Name,
+			StateClass:        sensor.config.StateClass,
+			ValueTemplate:     valueTemplate(device, sensor),
+			UniqueID:          uniqueID(device, sensor),
 			StateTopic:        GetStateTopic(device),
 			Icon:              sensor.config.Icon,
+			ExpireAfter:       sensor.config.ExpireAfter,
+		}
+		if sensor.HasAttributes() {
+			component.AttributesTopic = GetAttributesTopic(device, sensor)
+		}
+		if sensor.IsBinary() {
+			component.PayloadOn = BINARY_ON
+			component.PayloadOff = BINARY_OFF
 		}
-		autoDiscoveryDevice.Components[strcase.ToSnake(sensor.config.Name)] = component
+		if sensor.IsEvent() {
+			// Events carry their type and attributes in their own payload
+			component.StateTopic = GetEventTopic(device, sensor)
+			component.ValueTemplate = ""
+			component.EventTypes = sensor.config.EventTypes
+		}
+		if sensor.IsButton() {
+			component.StateTopic = ""
+			component.ValueTemplate = ""
+			component.CommandTopic = GetCommandTopic(device, sensor)
+		}
+		autoDiscoveryDevice.Components[sensor.Key()] = component
+	}
+	for _, removed := range device.GetRemovedComponents() {
+		autoDiscoveryDevice.Components[removed.key] = component{Platform: removed.platform}
 	}
 
 	jsonData, err := json.Marshal(autoDiscoveryDevice)
@@ -128,31 +174,28 @@ func FormatMQTTConfig(device *Device) (string, error) {
 	return string(jsonData), nil
 }
 
-// FormatMQTTValues formats the sensor values of a given device into a JSON string.
-// Each sensor value is rounded to two decimal places and converted to a snake_case key.
+// FormatMQTTValues formats the readings of a device snapshot into a JSON string.
+// Each value is stored under the snake_case key of its sensor. Readings holding an
+// error are left out of the payload.
 //
 // Parameters:
 //   - device: A pointer to the Device object containing the sensors.
+//   - snapshot: The snapshot holding the readings of the device's sensors.
 //
 // Returns:
 //   - A JSON string representation of the sensor values with snake_case keys.
-//   - An error if any issue occurs during value retrieval, conversion, or JSON marshaling.
-func FormatMQTTValues(device *Device) (string, error) {
+//   - An error if the JSON marshaling fails.
+func FormatMQTTValues(device *Device, snapshot *Snapshot) (string, error) {
 	// Create the state values
-	stateValues := map[string]float64{}
+	stateValues := map[string]any{}
 
 	// Fill the state values
 	for _, sensor := range device.GetSensors() {
-		value, err := sensor.GetSensorValue()
-		if err != nil {
-			return "", err
-		}
-		floatValue, err := strconv.ParseFloat(value, 64)
-		if err != nil {
-			return "", err
+		reading, ok := snapshot.Readings[sensor.Key()]
+		if !ok || reading.Err != nil {
+			continue
 		}
-		floatValue = math.Round(floatValue*100) / 100
-		stateValues[strcase.ToSnake(sensor.config.Name)] = floatValue
+		stateValues[sensor.Key()] = reading.Value
 	}
 
 	jsonData, err := json.Marshal(stateValues)
@@ -163,6 +206,64 @@ func FormatMQTTValues(device *Device) (string, error) {
 	return string(jsonData), nil
 }
 
+// FormatMQTTAttributes formats the attributes of a reading into a JSON string.
+//
+// Parameters:
+//   - reading: The reading holding the attributes.
+//
+// Returns:
+//   - A JSON string representation of the attributes.
+//   - An error if the JSON marshaling fails.
+func FormatMQTTAttributes(reading Reading) (string, error) {
+	jsonData, err := json.Marshal(reading.Attributes)
+	if err != nil {
+		return "", err
+	}
+	return string(jsonData), nil
+}
+
+// FormatMQTTEvent formats an event fired by an event entity into a JSON string.
+//
+// Parameters:
+//   - event: The event, holding its type and attributes.
+//
+// Returns:
+//   - A JSON string representation of the event.
+//   - An error if the JSON marshaling fails.
+func FormatMQTTEvent(event firedEvent) (string, error) {
+	jsonData, err := json.Marshal(event.payload)
+	if err != nil {
+		return "", err
+	}
+	return string(jsonData), nil
+}
+
+// uniqueID returns the unique identifier of a sensor in Home Assistant: its
+// configured identifier, or its name followed by the name of the device. Child
+// devices of different hosts may share a name, their sensors are identified by
+// the serial number of the child device instead.
+func uniqueID(device *Device, sensor *Sensor) string {
+	if sensor.config.UniqueID != "" {
+		return sensor.config.UniqueID
+	}
+	if device.GetParent() != nil {
+		return device.GetDeviceInfo().SerialNumber + "_" + sensor.Key()
+	}
+	return sensor.config.Name + "_" + device.GetDeviceInfo().Name
+}
+
+// valueTemplate returns the template extracting the value of a sensor from the
+// state payload. Sensors with a deadband are not always part of the payload, nor
+// are any of the sensors of a device with stream sensors, whose lines are published
+// on their own. Their current state is then kept.
+func valueTemplate(device *Device, sensor *Sensor) string {
+	key := sensor.Key()
+	if sensor.HasDeadband() || device.hasStreams() {
+		return "{{ value_json." + key + " if value_json." + key + " is defined else this.state }}"
+	}
+	return "{{ value_json." + key + " }}"
+}
+
 // GetConfigTopic generates the configuration topic string for a given device.
 // The topic is constructed using the device's serial number and a predefined
 // software name constant.
@@ -190,3 +291,74 @@ func GetConfigTopic(device *Device) string {
 func GetStateTopic(device *Device) string {
 	return SOFTWARE_NAME + "/" + device.GetDeviceInfo().SerialNumber + "/state"
 }
+
+// GetAvailabilityTopic generates the MQTT topic telling whether the agent is
+// online. The topic is constructed using the software name and the serial number
+// of the host, child devices share the topic of their parent.
+//
+// Parameters:
+//   - device: A pointer to a Device object containing the device information.
+//
+// Returns:
+//   - A string representing the MQTT availability topic.
+func GetAvailabilityTopic(device *Device) string {
+	return SOFTWARE_NAME + "/" + device.root().GetDeviceInfo().SerialNumber + "/availability"
+}
+
+// GetAttributesTopic generates the MQTT topic where the attributes of a sensor
+// are published. The topic is constructed using the software name, the device's
+// serial number and the key of the sensor.
+//
+// Parameters:
+//   - device: A pointer to the Device object owning the sensor.
+//   - sensor: A pointer to the Sensor object for which the topic is generated.
+//
+// Returns:
+//
+//	A string representing the MQTT attributes topic for the specified sensor.
+func GetAttributesTopic(device *Device, sensor *Sensor) string {
+	return SOFTWARE_NAME + "/" + device.GetDeviceInfo().SerialNumber + "/attributes/" + sensor.Key()
+}
+
+// GetEventTopic generates the MQTT topic where the events of an event entity
+// are published. The topic is constructed using the software name, the device's
+// serial number and the key of the entity.
+//
+// Parameters:
+//   - device: A pointer to the Device object owning the entity.
+//   - sensor: A pointer to the Sensor object of the event entity.
+//
+// Returns:
+//
+//	A string representing the MQTT event topic for the specified entity.
+func GetEventTopic(device *Device, sensor *Sensor) string {
+	return SOFTWARE_NAME + "/" + device.GetDeviceInfo().SerialNumber + "/event/" + sensor.Key()
+}
+
+// GetCommandTopic generates the MQTT topic where Home Assistant sends the presses
+// of a button. The topic is constructed using the software name, the device's
+// serial number and the key of the button.
+//
+// Parameters:
+//   - device: A pointer to the Device object owning the button.
+//   - sensor: A pointer to the Sensor object of the button.
+//
+// Returns:
+//
+//	A string representing the MQTT command topic for the specified button.
+func GetCommandTopic(device *Device, sensor *Sensor) string {
+	return SOFTWARE_NAME + "/" + device.GetDeviceInfo().SerialNumber + "/command/" + sensor.Key()
+}
+
+// GetCommandSubscription returns the MQTT topic filter matching the command topics
+// of the buttons of a device. The devices of other hosts are left out.
+//
+// Parameters:
+//   - device: A pointer to the Device object whose commands are received.
+//
+// Returns:
+//
+//	A string representing the MQTT topic filter for the commands of the device.
+func GetCommandSubscription(device *Device) string {
+	return SOFTWARE_NAME + "/" + device.GetDeviceInfo().SerialNumber + "/command/+"
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HomeAssistantSink is a Sink pushing the states of the sensors to Home Assistant
+// through its REST API, for the instances without MQTT server. Every sensor is an
+// entity named `sensor.<device>_<sensor>`, or `binary_sensor.<device>_<sensor>`,
+// with its metadata as attributes. Failed requests are retried with a backoff.
+//
+// Entities created this way are not part of the entity registry: they cannot be
+// renamed from the interface and disappear when Home Assistant restarts, until the
+// next refresh pushes them again.
+//
+// Fields:
+// - url: The base URL of Home Assistant.
+// - token: The long-lived access token of the Home Assistant user.
+// - timeout: The time Home Assistant is given to answer a request.
+// - retries: The number of times a failed request is retried.
+type HomeAssistantSink struct {
+	url     string
+	token   string
+	timeout time.Duration
+	retries int
+}
+
+// NewHomeAssistantSink creates a new Home Assistant sink from its configuration file entry.
+//
+// Parameters:
+//   - cfg: The sink entry of the configuration file.
+//
+// Returns:
+//   - A pointer to the newly created HomeAssistantSink instance.
+//   - An error if the configuration is invalid.
+func NewHomeAssistantSink(cfg SinkConfig) (*HomeAssistantSink, error) {
+	if cfg.URL == "" || cfg.Token == "" {
+		return nil, fmt.Errorf("homeassistant sink: url and token are required")
+	}
+	if cfg.TimeoutS < 0 || cfg.Retries != nil && *cfg.Retries < 0 {
+		return nil, fmt.Errorf("homeassistant sink: timeout and retries must not be negative")
+	}
+	sink := &HomeAssistantSink{
+		url:     strings.TrimSuffix(cfg.URL, "/"),
+		token:   cfg.Token,
+		timeout: DEFAULT_SINK_TIMEOUT,
+		retries: DEFAULT_SINK_RETRIES,
+	}
+	if cfg.TimeoutS > 0 {
+		sink.timeout = time.Duration(cfg.TimeoutS) * time.Second
+	}
+	if cfg.Retries != nil {
+		sink.retries = *cfg.Retries
+	}
+	return sink, nil
+}
+
+// Name returns the name of the sink, which includes the URL of Home Assistant.
+func (s *HomeAssistantSink) Name() string {
+	return "homeassistant:" + s.url
+}
+
+// Publish pushes the state of every reading of the snapshot. Failed readings make
+// their entity unavailable. The publication stops at the first request failing
+// after its retries, Home Assistant is likely unreachable.
+func (s *HomeAssistantSink) Publish(ctx context.Context, device *Device, snapshot *Snapshot) error {
+	for _, dev := range device.Devices() {
+		readings := snapshot.Of(dev).Readings
+		for _, sensor := range dev.GetSensors() {
+			reading, ok := readings[sensor.Key()]
+			if !ok || errors.Is(reading.Err, ErrNoValue) {
+				continue
+			}
+			entityID := homeAssistantEntityID(dev, sensor)
+			body, err := json.Marshal(map[string]any{
+				"state":      homeAssistantState(sensor, reading),
+				"attributes": homeAssistantAttributes(dev, sensor, reading),
+			})
+			if err != nil {
+				return err
+			}
+			err = withRetry(ctx, s.retries, func() error {
+				return s.post(ctx, "/api/states/"+entityID, body)
+			})
+			if err != nil {
+				return fmt.Errorf("%s: %w", entityID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// post sends a request to the REST API.
+func (s *HomeAssistantSink) post(ctx context.Context, path string, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return newHTTPStatusError("request", resp)
+	}
+	return nil
+}
+
+// homeAssistantEntityID returns the entity ID of a sensor, made of its platform, the
+// name of its device and its key, like the entities created by MQTT discovery.
+func homeAssistantEntityID(device *Device, sensor *Sensor) string {
+	platform := PLATFORM_SENSOR
+	if sensor.IsBinary() {
+		platform = PLATFORM_BINARY_SENSOR
+	}
+	// Entity IDs only accept lowercase ASCII letters, digits and underscores
+	objectID := invalidMetricPattern.ReplaceAllString(sensorKey(device.GetDeviceInfo().Name)+"_"+sensor.Key(), "_")
+	return platform + "." + strings.Trim(strings.ToLower(objectID), "_")
+}
+
+// homeAssistantState returns the state of a reading as expected by Home Assistant.
+func homeAssistantState(sensor *Sensor, reading Reading) string {
+	if reading.Err != nil {
+		return "unavailable"
+	}
+	switch value := reading.Value.(type) {
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case string:
+		if sensor.IsBinary() {
+			return strings.ToLower(value)
+		}
+		return value
+	}
+	return fmt.Sprint(reading.Value)
+}
+
+// homeAssistantAttributes returns the attributes of a reading along with the metadata
+// of its sensor, which take precedence.
+func homeAssistantAttributes(device *Device, sensor *Sensor, reading Reading) map[string]any {
+	attributes := map[string]any{}
+	for key, value := range reading.Attributes {
+		attributes[key] = value
+	}
+	attributes["friendly_name"] = device.GetDeviceInfo().Name + " " + sensor.config.Name
+	for key, value := range map[string]string{
+		"unit_of_measurement": sensor.config.UnitOfMeasurement,
+		"device_class":        sensor.config.DeviceClass,
+		"state_class":         sensor.config.StateClass,
+		"icon":                sensor.config.Icon,
+	} {
+		if value != "" {
+			attributes[key] = value
+		}
+	}
+	return attributes
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// hassRequest is a request received by the fake Home Assistant.
+type hassRequest struct {
+	path          string
+	authorization string
+	state         string
+	attributes    map[string]any
+}
+
+// fakeHomeAssistant is a REST API of Home Assistant answering the requests with
+// the given statuses in turn, then with 200, and recording them.
+type fakeHomeAssistant struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	requests []hassRequest
+}
+
+func newFakeHomeAssistant(t *testing.T, statuses ...int) *fakeHomeAssistant {
+	fake := &fakeHomeAssistant{statuses: statuses}
+	fake.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var state struct {
+			State      string         `json:"state"`
+			Attributes map[string]any `json:"attributes"`
+		}
+		if r.Method != http.MethodPost || json.Unmarshal(body, &state) != nil {
+			t.Errorf("unexpected request %s %s %q", r.Method, r.URL.Path, body)
+		}
+
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		fake.requests = append(fake.requests, hassRequest{
+			path:          r.URL.Path,
+			authorization: r.Header.Get("Authorization"),
+			state:         state.State,
+			attributes:    state.Attributes,
+		})
+		status := http.StatusOK
+		if len(fake.statuses) > 0 {
+			status, fake.statuses = fake.statuses[0], fake.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+// received returns the requests received so far.
+func (f *fakeHomeAssistant) received() []hassRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests
+}
+
+// newTestHomeAssistantSink returns a sink of the fake Home Assistant retrying once.
+func newTestHomeAssistantSink(t *testing.T, fake *fakeHomeAssistant) *HomeAssistantSink {
+	retries := 1
+	sink, err := NewHomeAssistantSink(SinkConfig{Type: SINK_TYPE_HOMEASSISTANT, URL: fake.URL + "/", Token: "secret-token", Retries: &retries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sink
+}
+
+func TestHomeAssistantSinkPublish(t *testing.T) {
+	fake := newFakeHomeAssistant(t)
+	sink := newTestHomeAssistantSink(t, fake)
+
+	device := NewDevice("Living Room", "Manufacturer", "Model", "sn-1")
+	temperature := NewSensor("Temperature", "echo 21.5", "temperature", "measurement", "°C", "mdi:thermometer", device)
+	device.AddSensor(temperature)
+	door, err := NewBinarySensorFromConfig(BinarySensorConfig{Name: "Door", DeviceClass: "door", Command: "true"}, device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device.AddSensor(door)
+	humidity := NewSensor("Humidity", "false", "humidity", "measurement", "%", "", device)
+	device.AddSensor(humidity)
+	waiting := NewSensor("Waiting", "", "", "", "", "", device)
+	device.AddSensor(waiting)
+
+	snapshot := NewSnapshot()
+	snapshot.Readings[temperature.Key()] = Reading{Value: 21.5, Attributes: map[string]any{"source": "probe", "icon": "mdi:ignored"}}
+	snapshot.Readings[door.Key()] = Reading{Value: BINARY_ON}
+	snapshot.Readings[humidity.Key()] = Reading{Err: errors.New("exit status 1")}
+	snapshot.Readings[waiting.Key()] = Reading{Err: ErrNoValue}
+	if err := sink.Publish(context.Background(), device, snapshot); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	want := []hassRequest{
+		{
+			path:          "/api/states/sensor.living_room_temperature",
+			authorization: "Bearer secret-token",
+			state:         "21.5",
+			attributes: map[string]any{
+				"source":              "probe",
+				"friendly_name":       "Living Room Temperature",
+				"unit_of_measurement": "°C",
+				"device_class":        "temperature",
+				"state_class":         "measurement",
+				"icon":                "mdi:thermometer",
+			},
+		},
+		{
+			path:          "/api/states/binary_sensor.living_room_door",
+			authorization: "Bearer secret-token",
+			state:         "on",
+			attributes: map[string]any{
+				"friendly_name": "Living Room Door",
+				"device_class":  "door",
+			},
+		},
+		{
+			path:          "/api/states/sensor.living_room_humidity",
+			authorization: "Bearer secret-token",
+			state:         "unavailable",
+			attributes: map[string]any{
+				"friendly_name":       "Living Room Humidity",
+				"unit_of_measurement": "%",
+				"device_class":        "humidity",
+				"state_class":         "measurement",
+			},
+		},
+	}
+	if got := fake.received(); !reflect.DeepEqual(got, want) {
+		t.Errorf("requests = %+v, want %+v", got, want)
+	}
+}
+
+func TestHomeAssistantSinkRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		requests int
+		fails    bool
+	}{
+		{name: "server error", statuses: []int{http.StatusServiceUnavailable}, requests: 2},
+		{name: "throttling", statuses: []int{http.StatusTooManyRequests}, requests: 2},
+		{name: "invalid token", statuses: []int{http.StatusUnauthorized}, requests: 1, fails: true},
+		{name: "retries exhausted", statuses: []int{http.StatusInternalServerError, http.StatusBadGateway}, requests: 2, fails: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The retries wait for SINK_RETRY_BACKOFF
+			t.Parallel()
+			fake := newFakeHomeAssistant(t, test.statuses...)
+			sink := newTestHomeAssistantSink(t, fake)
+			device := NewDevice("Host", "Manufacturer", "Model", "sn-1")
+			sensor := NewSensor("Load", "echo 1", "", "measurement", "", "", device)
+			device.AddSensor(sensor)
+			snapshot := NewSnapshot()
+			snapshot.Readings[sensor.Key()] = Reading{Value: 1.0}
+
+			err := sink.Publish(context.Background(), device, snapshot)
+			if (err != nil) != test.fails {
+				t.Errorf("Publish() error = %v, want failure %v", err, test.fails)
+			}
+			if got := len(fake.received()); got != test.requests {
+				t.Errorf("%d requests, want %d", got, test.requests)
+			}
+		})
+	}
+}
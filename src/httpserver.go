@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// localServer is a local HTTP server started by the agent, such as the Prometheus
+// exporter or the status API. Its listener is bound when it is created, so that an
+// address already in use is reported at startup, and it serves nothing until Start.
+//
+// Fields:
+// - section: The section of the configuration file of the server, naming it in errors.
+// - listener: The listener of the HTTP server.
+// - server: The HTTP server, whose handler is set by the owner of the server.
+type localServer struct {
+	section  string
+	listener net.Listener
+	server   *http.Server
+}
+
+// newLocalServer binds the listener of a local HTTP server.
+//
+// Parameters:
+//   - section: The section of the configuration file of the server.
+//   - address: The address the server listens on.
+//   - handler: The handler of the requests.
+//
+// Returns:
+//   - A pointer to the newly created localServer instance.
+//   - An error if the address is missing or cannot be bound.
+func newLocalServer(section string, address string, handler http.Handler) (*localServer, error) {
+	if address == "" {
+		return nil, fmt.Errorf("%s: listen address is required", section)
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", section, err)
+	}
+	return &localServer{
+		section:  section,
+		listener: listener,
+		server:   &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second},
+	}, nil
+}
+
+// Start serves the requests in the background.
+func (s *localServer) Start() {
+	go func() {
+		if err := s.server.Serve(s.listener); err != nil && err != http.ErrServerClosed {
+			slog.Error("Error serving", "server", s.section, "error", err)
+		}
+	}()
+}
+
+// Stop closes the listener and the open connections.
+func (s *localServer) Stop() {
+	s.server.Close()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_INFLUXDB_MEASUREMENT = "penguinhomelink"
+	DEFAULT_SINK_TIMEOUT         = 10 * time.Second
+)
+
+var (
+	// influxMeasurementEscaper escapes the measurement of a line of the line protocol.
+	influxMeasurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `, "\n", `\n`)
+	// influxTagEscaper escapes the keys and values of the tags.
+	influxTagEscaper = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `, "\n", `\n`)
+	// influxStringEscaper escapes the string field values, written between quotes.
+	influxStringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+// InfluxDBSink is a Sink writing the readings to an InfluxDB v2 server in the line
+// protocol, one point per sensor. Numbers are written to the `value` field, binary
+// states as 1 or 0, and enum states to the `state` field. Failed readings are left out.
+//
+// Fields:
+// - name: The name of the sink, which includes the URL of the server.
+// - writeURL: The URL of the write endpoint, with the organization and the bucket.
+// - token: The API token of the server.
+// - measurement: The measurement of the points.
+// - timeout: The time the server is given to answer.
+type InfluxDBSink struct {
+	name        string
+	writeURL    string
+	token       string
+	measurement string
+	timeout     time.Duration
+}
+
+// NewInfluxDBSink creates a new InfluxDB sink from its configuration file entry.
+//
+// Parameters:
+//   - cfg: The sink entry of the configuration file.
+//
+// Returns:
+//   - A pointer to the newly created InfluxDBSink instance.
+//   - An error if the configuration is invalid.
+func NewInfluxDBSink(cfg SinkConfig) (*InfluxDBSink, error) {
+	if cfg.URL == "" || cfg.Org == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("influxdb sink: url, org and bucket are required")
+	}
+	if cfg.TimeoutS < 0 {
+		return nil, fmt.Errorf("influxdb sink: timeout must not be negative")
+	}
+	query := url.Values{}
+	query.Set("org", cfg.Org)
+	query.Set("bucket", cfg.Bucket)
+	query.Set("precision", "ns")
+	sink := &InfluxDBSink{
+		name:        "influxdb:" + cfg.URL,
+		writeURL:    strings.TrimSuffix(cfg.URL, "/") + "/api/v2/write?" + query.Encode(),
+		token:       cfg.Token,
+		measurement: cfg.Measurement,
+		timeout:     DEFAULT_SINK_TIMEOUT,
+	}
+	if sink.measurement == "" {
+		sink.measurement = DEFAULT_INFLUXDB_MEASUREMENT
+	}
+	if cfg.TimeoutS > 0 {
+		sink.timeout = time.Duration(cfg.TimeoutS) * time.Second
+	}
+	return sink, nil
+}
+
+// Name returns the name of the sink.
+func (s *InfluxDBSink) Name() string {
+	return s.name
+}
+
+// Publish writes a point for every reading of the snapshot.
+func (s *InfluxDBSink) Publish(ctx context.Context, device *Device, snapshot *Snapshot) error {
+	var body bytes.Buffer
+	for _, dev := range device.Devices() {
+		readings := snapshot.Of(dev).Readings
+		for _, sensor := range dev.GetSensors() {
+			reading, ok := readings[sensor.Key()]
+			if !ok || reading.Err != nil {
+				continue
+			}
+			if line := s.formatLine(dev, sensor, reading, snapshot.Time); line != "" {
+				body.WriteString(line)
+				body.WriteByte('\n')
+			}
+		}
+	}
+	if body.Len() == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.writeURL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Token "+s.token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return newHTTPStatusError("write", resp)
+	}
+	return nil
+}
+
+// formatLine formats the point of a reading in the line protocol, or returns an
+// empty string when the reading has no value to write.
+func (s *InfluxDBSink) formatLine(device *Device, sensor *Sensor, reading Reading, fallback time.Time) string {
+	var field string
+	switch value := reading.Value.(type) {
+	case float64:
+		field = "value=" + strconv.FormatFloat(value, 'f', -1, 64)
+	case string:
+		if sensor.IsBinary() {
+			field = "value=" + strconv.FormatFloat(boolToFloat(value == BINARY_ON), 'f', -1, 64)
+		} else {
+			field = `state="` + influxStringEscaper.Replace(value) + `"`
+		}
+	default:
+		return ""
+	}
+
+	// Empty tags are not allowed by the line protocol, they are left out
+	var line strings.Builder
+	line.WriteString(influxMeasurementEscaper.Replace(s.measurement))
+	for _, tag := range [][2]string{
+		{"serial", device.GetDeviceInfo().SerialNumber},
+		{"device", device.GetDeviceInfo().Name},
+		{"sensor", sensor.Key()},
+		{"unit", sensor.config.UnitOfMeasurement},
+		{"device_class", sensor.config.DeviceClass},
+	} {
+		if tag[1] != "" {
+			line.WriteString("," + tag[0] + "=" + influxTagEscaper.Replace(tag[1]))
+		}
+	}
+	timestamp := reading.Time
+	if timestamp.IsZero() {
+		timestamp = fallback
+	}
+	line.WriteString(" " + field + " " + strconv.FormatInt(timestamp.UnixNano(), 10))
+	return line.String()
+}
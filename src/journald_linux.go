@@ -0,0 +1,13 @@
+//go:build linux
+
+package main
+
+import "net"
+
+// JOURNALD_SOCKET is the socket of the native protocol of journald.
+const JOURNALD_SOCKET = "/run/systemd/journal/socket"
+
+// dialJournald connects to the socket of journald.
+func dialJournald() (net.Conn, error) {
+	return net.Dial("unixgram", JOURNALD_SOCKET)
+}
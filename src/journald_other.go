@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// dialJournald is not available outside Linux, where journald runs.
+func dialJournald() (net.Conn, error) {
+	return nil, fmt.Errorf("journald is only supported on Linux")
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	DEFAULT_SINK_MAX_SIZE_MB = 10
+	DEFAULT_SINK_MAX_FILES   = 5
+)
+
+// jsonRecord represents a line written by the JSON-lines sinks: a reading, or an
+// event when Event is set.
+type jsonRecord struct {
+	Time   time.Time      `json:"time"`
+	Serial string         `json:"serial"`
+	Device string         `json:"device"`
+	Sensor string         `json:"sensor"`
+	Key    string         `json:"key"`
+	Value  any            `json:"value,omitempty"`
+	Error  string         `json:"error,omitempty"`
+	Unit   string         `json:"unit,omitempty"`
+	Event  map[string]any `json:"event,omitempty"`
+}
+
+// formatJSONLines formats the readings and the events of a snapshot as JSON lines.
+// Sensors still waiting for a value are left out.
+func formatJSONLines(device *Device, snapshot *Snapshot) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	for _, dev := range device.Devices() {
+		readings := snapshot.Of(dev).Readings
+		for _, sensor := range dev.GetSensors() {
+			reading, ok := readings[sensor.Key()]
+			if !ok || errors.Is(reading.Err, ErrNoValue) {
+				continue
+			}
+			record := newJSONRecord(dev, sensor, reading.Time, snapshot.Time)
+			if reading.Err != nil {
+				record.Error = reading.Err.Error()
+			} else {
+				record.Value = reading.Value
+			}
+			if err := encoder.Encode(record); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, event := range snapshot.Events {
+		record := newJSONRecord(event.sensor.Device, event.sensor, time.Time{}, snapshot.Time)
+		record.Event = event.payload
+		if err := encoder.Encode(record); err != nil {
+			return nil, err
+		}
+	}
+	return buffer.Bytes(), nil
+}
+
+// newJSONRecord returns the record of a sensor of a device, taken at the given time
+// or, when it is unknown, at the time of the snapshot.
+func newJSONRecord(device *Device, sensor *Sensor, at time.Time, fallback time.Time) jsonRecord {
+	if at.IsZero() {
+		at = fallback
+	}
+	return jsonRecord{
+		Time:   at,
+		Serial: device.GetDeviceInfo().SerialNumber,
+		Device: device.GetDeviceInfo().Name,
+		Sensor: sensor.config.Name,
+		Key:    sensor.Key(),
+		Unit:   sensor.config.UnitOfMeasurement,
+	}
+}
+
+// FileSink is a Sink appending the readings and the events to a local file as JSON
+// lines. The file is rotated once it reaches its maximum size: path becomes path.1,
+// path.1 becomes path.2, and so on up to the number of kept files.
+//
+// Fields:
+// - path: The file the lines are appended to.
+// - maxSize: The size in bytes at which the file is rotated.
+// - maxFiles: The number of rotated files kept.
+// - file: The open file, or nil until the next publication.
+// - size: The current size of the open file.
+type FileSink struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+// NewFileSink creates a new file sink from its configuration file entry. The file
+// is opened with the first publication.
+//
+// Parameters:
+//   - cfg: The sink entry of the configuration file.
+//
+// Returns:
+//   - A pointer to the newly created FileSink instance.
+//   - An error if the configuration is invalid.
+func NewFileSink(cfg SinkConfig) (*FileSink, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("file sink: path is required")
+	}
+	if cfg.MaxSizeMB < 0 || cfg.MaxFiles < 0 {
+		return nil, fmt.Errorf("file sink %q: max_size_mb and max_files must not be negative", cfg.Path)
+	}
+	sink := &FileSink{
+		path:     cfg.Path,
+		maxSize:  DEFAULT_SINK_MAX_SIZE_MB << 20,
+		maxFiles: DEFAULT_SINK_MAX_FILES,
+	}
+	if cfg.MaxSizeMB > 0 {
+		sink.maxSize = int64(cfg.MaxSizeMB) << 20
+	}
+	if cfg.MaxFiles > 0 {
+		sink.maxFiles = cfg.MaxFiles
+	}
+	return sink, nil
+}
+
+// Name returns the name of the sink, which includes its path since several files
+// may be written.
+func (s *FileSink) Name() string {
+	return "file:" + s.path
+}
+
+// Publish appends the lines of the snapshot to the file, rotating it first when
+// they would not fit.
+func (s *FileSink) Publish(ctx context.Context, device *Device, snapshot *Snapshot) error {
+	lines, err := formatJSONLines(device, snapshot)
+	if err != nil || len(lines) == 0 {
+		return err
+	}
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if s.size > 0 && s.size+int64(len(lines)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	written, err := s.file.Write(lines)
+	s.size += int64(written)
+	if err != nil {
+		// Reopen the file with the next publication, it may have been removed
+		s.Close()
+		return err
+	}
+	return nil
+}
+
+// Close closes the file.
+func (s *FileSink) Close() {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+}
+
+// open opens the file for appending and records its current size.
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+// rotate closes the file and shifts it and the rotated files, the oldest one is
+// dropped.
+func (s *FileSink) rotate() error {
+	s.Close()
+	os.Remove(fmt.Sprintf("%s.%d", s.path, s.maxFiles))
+	for i := s.maxFiles - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(s.path, s.path+".1")
+}
+
+// StdoutSink is a Sink printing the readings and the events to the standard output
+// as JSON lines, for debugging or to pipe them to another program.
+type StdoutSink struct{}
+
+// NewStdoutSink creates a new stdout sink.
+func NewStdoutSink() *StdoutSink {
+	return &StdoutSink{}
+}
+
+// Name returns the name of the sink.
+func (s *StdoutSink) Name() string {
+	return "stdout"
+}
+
+// Publish prints the lines of the snapshot.
+func (s *StdoutSink) Publish(ctx context.Context, device *Device, snapshot *Snapshot) error {
+	lines, err := formatJSONLines(device, snapshot)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(lines)
+	return err
+}
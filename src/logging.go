@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LOG_FORMAT_TEXT = "text"
+	LOG_FORMAT_JSON = "json"
+
+	LOG_OUTPUT_STDERR   = "stderr"
+	LOG_OUTPUT_STDOUT   = "stdout"
+	LOG_OUTPUT_JOURNALD = "journald"
+
+	// DEFAULT_LOG_REPEAT_INTERVAL is the time during which a repeated warning or
+	// error is only logged once, when the configuration does not set one.
+	DEFAULT_LOG_REPEAT_INTERVAL = 5 * time.Minute
+
+	// JOURNALD_IDENTIFIER is the SYSLOG_IDENTIFIER of the entries sent to journald.
+	JOURNALD_IDENTIFIER = "penguinhomelink"
+)
+
+// SetupLogging replaces the default logger according to the logging section of
+// the configuration file. Repeated warnings and errors are suppressed whatever the
+// output.
+//
+// Parameters:
+//   - cfg: The logging section of the configuration file.
+//
+// Returns:
+//   - An error if the configuration is invalid or journald cannot be reached.
+func SetupLogging(cfg LoggingConfig) error {
+	level := slog.LevelInfo
+	if cfg.Level != "" {
+		if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+			return fmt.Errorf("logging: %w", err)
+		}
+	}
+	if cfg.RepeatIntervalS < 0 {
+		return fmt.Errorf("logging: repeat_interval_s must not be negative")
+	}
+	repeatInterval := DEFAULT_LOG_REPEAT_INTERVAL
+	if cfg.RepeatIntervalS > 0 {
+		repeatInterval = time.Duration(cfg.RepeatIntervalS) * time.Second
+	}
+
+	var handler slog.Handler
+	switch cfg.Output {
+	case "", LOG_OUTPUT_STDERR, LOG_OUTPUT_STDOUT:
+		var output io.Writer = os.Stderr
+		if cfg.Output == LOG_OUTPUT_STDOUT {
+			output = os.Stdout
+		}
+		options := &slog.HandlerOptions{Level: level}
+		switch cfg.Format {
+		case "", LOG_FORMAT_TEXT:
+			handler = slog.NewTextHandler(output, options)
+		case LOG_FORMAT_JSON:
+			handler = slog.NewJSONHandler(output, options)
+		default:
+			return fmt.Errorf("logging: unknown format %q", cfg.Format)
+		}
+	case LOG_OUTPUT_JOURNALD:
+		conn, err := dialJournald()
+		if err != nil {
+			return fmt.Errorf("logging: %w", err)
+		}
+		handler = &journaldHandler{conn: conn, level: level, mu: &sync.Mutex{}}
+	default:
+		return fmt.Errorf("logging: unknown output %q", cfg.Output)
+	}
+
+	slog.SetDefault(slog.New(&repeatHandler{
+		next:     handler,
+		interval: repeatInterval,
+		state:    &repeatState{seen: map[string]*repeatedRecord{}},
+	}))
+	return nil
+}
+
+// repeatedRecord represents a warning or an error logged recently, and the number
+// of times it was suppressed since.
+type repeatedRecord struct {
+	logged     time.Time
+	suppressed int
+}
+
+// repeatState represents the records logged recently, shared by a handler and the
+// handlers derived from it.
+type repeatState struct {
+	mu   sync.Mutex
+	seen map[string]*repeatedRecord
+}
+
+// repeatHandler is a slog.Handler suppressing the warnings and the errors repeated
+// within an interval, such as those of a sensor failing at every cycle. The record
+// logged once the interval elapsed tells how many times it was suppressed. Records
+// are identical when they have the same level, message and attributes, except for
+// their duration.
+//
+// Fields:
+// - next: The handler writing the records.
+// - interval: The time during which a repeated record is suppressed.
+// - attrs: The attributes of the handler, part of the identity of its records.
+// - state: The records logged recently.
+type repeatHandler struct {
+	next     slog.Handler
+	interval time.Duration
+	attrs    string
+	state    *repeatState
+}
+
+func (h *repeatHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *repeatHandler) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level < slog.LevelWarn {
+		return h.next.Handle(ctx, record)
+	}
+
+	var key strings.Builder
+	fmt.Fprintf(&key, "%s|%s|%s", record.Level, record.Message, h.attrs)
+	record.Attrs(func(attr slog.Attr) bool {
+		if attr.Key != "duration" {
+			fmt.Fprintf(&key, "|%s=%s", attr.Key, attr.Value)
+		}
+		return true
+	})
+
+	h.state.mu.Lock()
+	now := time.Now()
+	seen, ok := h.state.seen[key.String()]
+	if ok && now.Sub(seen.logged) < h.interval {
+		seen.suppressed++
+		h.state.mu.Unlock()
+		return nil
+	}
+	suppressed := 0
+	if ok {
+		suppressed = seen.suppressed
+	}
+	// Forget the records which are no longer repeated, the suppressed ones are
+	// reported when they come back
+	for other, record := range h.state.seen {
+		if record.suppressed == 0 && now.Sub(record.logged) >= h.interval {
+			delete(h.state.seen, other)
+		}
+	}
+	h.state.seen[key.String()] = &repeatedRecord{logged: now}
+	h.state.mu.Unlock()
+
+	if suppressed > 0 {
+		record = record.Clone()
+		record.AddAttrs(slog.Int("suppressed", suppressed))
+	}
+	return h.next.Handle(ctx, record)
+}
+
+func (h *repeatHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	derived := *h
+	derived.next = h.next.WithAttrs(attrs)
+	for _, attr := range attrs {
+		derived.attrs += fmt.Sprintf("|%s=%s", attr.Key, attr.Value)
+	}
+	return &derived
+}
+
+func (h *repeatHandler) WithGroup(name string) slog.Handler {
+	derived := *h
+	derived.next = h.next.WithGroup(name)
+	derived.attrs += "|" + name + "."
+	return &derived
+}
+
+// journaldHandler is a slog.Handler sending the records to journald with its native
+// protocol, so that their attributes become fields of the journal entries, e.g.
+// `journalctl SENSOR=cpu_temperature`. The levels are mapped to the syslog priorities.
+//
+// Fields:
+// - conn: The datagram socket of journald.
+// - level: The minimum level of the records sent.
+// - attrs: The attributes of the handler, already encoded as fields.
+// - group: The prefix of the fields of the attributes, from the groups of the handler.
+// - mu: Serializes the writes to the socket, shared by the derived handlers.
+type journaldHandler struct {
+	conn  net.Conn
+	level slog.Leveler
+	attrs []byte
+	group string
+	mu    *sync.Mutex
+}
+
+func (h *journaldHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *journaldHandler) Handle(ctx context.Context, record slog.Record) error {
+	var entry bytes.Buffer
+	writeJournaldField(&entry, "MESSAGE", record.Message)
+	writeJournaldField(&entry, "PRIORITY", journaldPriority(record.Level))
+	writeJournaldField(&entry, "SYSLOG_IDENTIFIER", JOURNALD_IDENTIFIER)
+	entry.Write(h.attrs)
+	record.Attrs(func(attr slog.Attr) bool {
+		writeJournaldAttr(&entry, h.group, attr)
+		return true
+	})
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.conn.Write(entry.Bytes())
+	return err
+}
+
+func (h *journaldHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	derived := *h
+	var encoded bytes.Buffer
+	encoded.Write(h.attrs)
+	for _, attr := range attrs {
+		writeJournaldAttr(&encoded, h.group, attr)
+	}
+	derived.attrs = encoded.Bytes()
+	return &derived
+}
+
+func (h *journaldHandler) WithGroup(name string) slog.Handler {
+	derived := *h
+	derived.group += name + "_"
+	return &derived
+}
+
+// journaldPriority returns the syslog priority of a level.
+func journaldPriority(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return "3"
+	case level >= slog.LevelWarn:
+		return "4"
+	case level >= slog.LevelInfo:
+		return "6"
+	}
+	return "7"
+}
+
+// writeJournaldAttr encodes an attribute as a field, and the attributes of a group
+// as fields prefixed with its name.
+func writeJournaldAttr(entry *bytes.Buffer, prefix string, attr slog.Attr) {
+	value := attr.Value.Resolve()
+	if value.Kind() == slog.KindGroup {
+		for _, member := range value.Group() {
+			writeJournaldAttr(entry, prefix+attr.Key+"_", member)
+		}
+		return
+	}
+	writeJournaldField(entry, prefix+attr.Key, value.String())
+}
+
+// writeJournaldField encodes a field of the native protocol. Names only hold
+// uppercase letters, digits and underscores, and may not start with an underscore,
+// which is reserved to the fields set by journald. Values holding a newline are
+// encoded with their length.
+func writeJournaldField(entry *bytes.Buffer, name string, value string) {
+	name = strings.TrimLeft(strings.ToUpper(invalidMetricPattern.ReplaceAllString(name, "_")), "_0123456789")
+	if name == "" {
+		return
+	}
+	entry.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		entry.WriteString("=" + value + "\n")
+		return
+	}
+	entry.WriteByte('\n')
+	binary.Write(entry, binary.LittleEndian, uint64(len(value)))
+	entry.WriteString(value + "\n")
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	LOG_MATCH_COUNT = "count"
+	LOG_MATCH_RATE  = "rate"
+	LOG_MATCH_LAST  = "last_match"
+
+	// LOG_EVENT_TYPE is the type of the events fired by the log watchers.
+	LOG_EVENT_TYPE = "match"
+	// MAX_STATE_LENGTH is the maximum length of a text state accepted by Home Assistant.
+	MAX_STATE_LENGTH = 255
+)
+
+// logMatch represents a regular expression searched in a log file, and the
+// matches found since the watcher started.
+//
+// Fields:
+// - name: The name of the entity reporting the matches.
+// - kind: The value reported by the entity: count, rate or last_match.
+// - regex: The regular expression matched against every new line.
+// - icon: The icon of the entity.
+// - event: Whether an event is fired at every match.
+// - count: The number of matches since the watcher started.
+// - window: The number of matches since the previous collection.
+// - last: The last matching line, nil until the first match.
+// - events: The events fired since the previous collection.
+type logMatch struct {
+	name  string
+	kind  string
+	regex *regexp.Regexp
+	icon  string
+	event bool
+
+	count  float64
+	window float64
+	last   any
+	events []map[string]any
+}
+
+// LogWatcher is a Collector following a log file like `tail -F`: at every cycle it
+// reads the lines appended since the previous cycle and matches them against its
+// regular expressions. A rotated file, detected by its inode, is read to its end
+// before following the new file, and a truncated file is read from its start.
+//
+// Fields:
+// - path: The path of the log file.
+// - matches: The regular expressions searched in the file.
+// - file: The file being followed, nil until it exists.
+// - info: The information of the followed file, identifying its inode.
+// - offset: The position of the next byte to read in the followed file.
+// - partial: The end of the file which is not a complete line yet.
+// - started: Whether the file was opened once; the first file is read from its end.
+// - lastCollect: The time of the previous collection, for rates.
+type LogWatcher struct {
+	path    string
+	matches []*logMatch
+
+	file        *os.File
+	info        os.FileInfo
+	offset      int64
+	partial     string
+	started     bool
+	lastCollect time.Time
+}
+
+// NewLogWatcher creates a new log watcher from its configuration file entry.
+// The file is opened by the first collection.
+//
+// Parameters:
+//   - cfg: The log watcher entry of the configuration file.
+//
+// Returns:
+//   - A pointer to the newly created LogWatcher instance.
+//   - An error if the configuration is invalid.
+func NewLogWatcher(cfg LogWatcherConfig) (*LogWatcher, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("log watchers need a path")
+	}
+	if len(cfg.Matches) == 0 {
+		return nil, fmt.Errorf("log watcher %q: no matches configured", cfg.Path)
+	}
+	watcher := &LogWatcher{path: cfg.Path}
+	for _, matchConfig := range cfg.Matches {
+		if matchConfig.Name == "" {
+			return nil, fmt.Errorf("log watcher %q: matches need a name", cfg.Path)
+		}
+		kind := matchConfig.Type
+		if kind == "" {
+			kind = LOG_MATCH_COUNT
+		}
+		if kind != LOG_MATCH_COUNT && kind != LOG_MATCH_RATE && kind != LOG_MATCH_LAST {
+			return nil, fmt.Errorf("log watcher %q: match %q has unknown type %q", cfg.Path, matchConfig.Name, kind)
+		}
+		regex, err := regexp.Compile(matchConfig.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("log watcher %q: match %q: %w", cfg.Path, matchConfig.Name, err)
+		}
+		watcher.matches = append(watcher.matches, &logMatch{
+			name:  matchConfig.Name,
+			kind:  kind,
+			regex: regex,
+			icon:  matchConfig.Icon,
+			event: matchConfig.Event,
+		})
+	}
+	return watcher, nil
+}
+
+// Name returns the path of the followed file.
+func (w *LogWatcher) Name() string {
+	return w.path
+}
+
+// Collect reads the new lines of the file and returns the entities of the matches.
+func (w *LogWatcher) Collect(ctx context.Context) ([]CollectedEntity, error) {
+	now := time.Now()
+	if err := w.follow(); err != nil {
+		return nil, err
+	}
+	elapsed := now.Sub(w.lastCollect)
+	first := w.lastCollect.IsZero()
+	w.lastCollect = now
+
+	var entities []CollectedEntity
+	for _, match := range w.matches {
+		entity := CollectedEntity{
+			Name: match.name,
+			Icon: match.icon,
+		}
+		switch match.kind {
+		case LOG_MATCH_COUNT:
+			entity.Value = match.count
+			entity.StateClass = "total_increasing"
+		case LOG_MATCH_RATE:
+			// The first window starts when the file is opened, it has no duration
+			if !first {
+				entity.Value = match.window / elapsed.Minutes()
+			}
+			entity.Unit = "matches/min"
+			entity.StateClass = "measurement"
+		case LOG_MATCH_LAST:
+			entity.Value = match.last
+			entity.DeviceClass = "enum"
+		}
+		match.window = 0
+		entities = append(entities, entity)
+
+		if match.event {
+			entities = append(entities, CollectedEntity{
+				Name:       match.name + " Event",
+				Platform:   PLATFORM_EVENT,
+				Icon:       match.icon,
+				EventTypes: []string{LOG_EVENT_TYPE},
+				Events:     match.events,
+			})
+			match.events = nil
+		}
+	}
+	return entities, nil
+}
+
+// Stop closes the followed file.
+func (w *LogWatcher) Stop() {
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+}
+
+// follow reads the lines appended to the file since the previous call, following
+// the file through rotations and truncations.
+func (w *LogWatcher) follow() error {
+	info, statErr := os.Stat(w.path)
+	if w.file == nil {
+		if statErr != nil {
+			return statErr
+		}
+		if err := w.open(info); err != nil {
+			return err
+		}
+	}
+
+	if err := w.readNewLines(); err != nil {
+		return err
+	}
+
+	// The path now points to another file, the followed one was rotated
+	if statErr == nil && !os.SameFile(w.info, info) {
+		w.flushPartial()
+		w.file.Close()
+		w.file = nil
+		if err := w.open(info); err != nil {
+			return err
+		}
+		return w.readNewLines()
+	}
+	return nil
+}
+
+// open starts following the file at the path. The file found at startup is read
+// from its end, the files created afterwards are read from their start.
+func (w *LogWatcher) open(info os.FileInfo) error {
+	file, err := os.Open(w.path)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.info = info
+	w.offset = 0
+	if !w.started {
+		w.offset = info.Size()
+		w.started = true
+	}
+	return nil
+}
+
+// readNewLines reads the followed file from the last offset to its end, and
+// matches every complete line.
+func (w *LogWatcher) readNewLines() error {
+	info, err := w.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < w.offset {
+		// The file was truncated in place, start over
+		w.offset = 0
+		w.partial = ""
+	}
+
+	data, err := io.ReadAll(io.NewSectionReader(w.file, w.offset, info.Size()-w.offset))
+	if err != nil {
+		return err
+	}
+	w.offset += int64(len(data))
+
+	lines := strings.Split(w.partial+string(data), "\n")
+	w.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		w.matchLine(strings.TrimSuffix(line, "\r"))
+	}
+	return nil
+}
+
+// flushPartial matches the last line of a rotated file, even without its newline.
+func (w *LogWatcher) flushPartial() {
+	if w.partial != "" {
+		w.matchLine(w.partial)
+		w.partial = ""
+	}
+}
+
+// matchLine updates the matches with a new line of the file.
+func (w *LogWatcher) matchLine(line string) {
+	for _, match := range w.matches {
+		groups := match.regex.FindStringSubmatch(line)
+		if groups == nil {
+			continue
+		}
+		match.count++
+		match.window++
+		match.last = truncateState(strings.TrimSpace(line))
+		if match.event {
+			match.events = append(match.events, matchEvent(match.regex, groups, line))
+		}
+	}
+}
+
+// matchEvent builds the event fired for a match. The captured groups are added
+// to the event under their name, or under group_N when they have none.
+func matchEvent(regex *regexp.Regexp, groups []string, line string) map[string]any {
+	event := map[string]any{
+		"event_type": LOG_EVENT_TYPE,
+		"line":       line,
+	}
+	for i, name := range regex.SubexpNames() {
+		if i == 0 {
+			continue
+		}
+		if name == "" {
+			name = "group_" + strconv.Itoa(i)
+		}
+		event[name] = groups[i]
+	}
+	return event
+}
+
+// truncateState shortens a text so that Home Assistant accepts it as a state.
+func truncateState(text string) string {
+	if len(text) <= MAX_STATE_LENGTH {
+		return text
+	}
+	return strings.ToValidUTF8(text[:MAX_STATE_LENGTH], "")
+}
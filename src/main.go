@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -13,6 +19,9 @@ const (
 
 	RETRY_PAUSE           = 30 * time.Second // 2 * time.Minute
 	CONFIG_REFRESH_PERIOD = 15 * time.Minute
+	// SHUTDOWN_GRACE_PERIOD is the time the running cycle or command is given to
+	// end once the agent is asked to stop.
+	SHUTDOWN_GRACE_PERIOD = 10 * time.Second
 )
 
 func main() {
@@ -20,115 +29,374 @@ func main() {
 		panic("Usage: PenguinHomeLink <config-file-path>")
 	}
 	configFilePath := os.Args[1]
-	fmt.Println("Starting PenguinHomeLink...")
 
-	fmt.Println(">> Configuring...")
 	// Parse the confuguration file
-	fmt.Println(">> Loading configuration...")
-
 	config, err := LoadConfig(configFilePath)
 	if err != nil {
 		panic(err)
 	}
-	// Print the configuration
-	fmt.Println(">> Configuration loaded successfully.")
-	//fmt.Printf("%+v\n", config)
+	// Log as configured from now on
+	if err := SetupLogging(config.Logging); err != nil {
+		panic(err)
+	}
+	slog.Info("Starting PenguinHomeLink", "version", SOFTWARE_VERSION, "config", configFilePath)
 
 	//create the device
-	fmt.Println(">> Creating device and sensors...")
+	slog.Debug("Creating device and sensors")
 	device := NewDevice(config.Device.Name, config.Device.Manufacturer, config.Device.Model, config.Device.SerialNumber)
+	// Restore the state of the counter sensors
+	stateStore, err := LoadStateStore(config.Software.StateFile)
+	if err != nil {
+		panic(err)
+	}
+	device.SetStateStore(stateStore)
 	// Print the device information
 	//fmt.Printf("%+v\n", device.GetDeviceInfo())
 
 	// Create the sensors
-	for _, sensorConfig := range config.Sensors {
-		sensor := NewSensor(sensorConfig.Name, sensorConfig.Command, sensorConfig.DeviceClass, sensorConfig.StateClass, sensorConfig.UnitOfMeasurement, sensorConfig.Icon, device)
-		device.AddSensor(sensor)
+	addSensors(device, config.Sensors)
+	// Generate the sensors of the discovered hardware along the configured ones
+	if config.Autodiscover != nil {
+		device.SetAutodiscovery(*config.Autodiscover, config.Sensors)
+		added, _, err := device.ReloadDiscoveredSensors()
+		if err != nil {
+			panic(err)
+		}
+		slog.Info("Hardware sensors discovered", "count", added)
+	}
+	for _, pluginConfig := range config.Plugins {
+		plugin, err := NewPluginFromConfig(pluginConfig)
+		if err != nil {
+			panic(err)
+		}
+		device.AddCollector(plugin)
+	}
+	// Prometheus series come and go, their entities follow them like those of plugins
+	for _, sourceConfig := range config.PrometheusSources {
+		source, err := NewPrometheusSource(sourceConfig)
+		if err != nil {
+			panic(err)
+		}
+		device.AddCollector(source)
+	}
+	// Log watchers are collected like plugins, their entities follow the matches
+	for _, logWatcherConfig := range config.LogWatchers {
+		watcher, err := NewLogWatcher(logWatcherConfig)
+		if err != nil {
+			panic(err)
+		}
+		device.AddCollector(watcher)
+	}
+	for _, processConfig := range config.Processes {
+		monitor, err := NewProcessMonitor(processConfig)
+		if err != nil {
+			panic(err)
+		}
+		device.AddCollector(monitor)
+	}
+	if config.SystemdUnits != nil {
+		units, err := NewSystemdUnits(*config.SystemdUnits)
+		if err != nil {
+			panic(err)
+		}
+		device.AddCollector(units)
+	}
+	// Every container is published as a device of its own, linked to the host
+	if config.Docker != nil {
+		docker, err := NewDockerMonitor(*config.Docker)
+		if err != nil {
+			panic(err)
+		}
+		device.AddCollector(docker)
+	}
+	// Binary sensors last, their thresholds refer to the sensors above
+	addBinarySensors(device, config.BinarySensors)
+	// Declared devices are linked to the host, their sensors are created like its own
+	for _, childConfig := range config.Devices {
+		id := childConfig.ID
+		if id == "" {
+			id = childConfig.Name
+		}
+		child, err := device.AddChildDevice(id, childConfig.Name, childConfig.Manufacturer, childConfig.Model)
+		if err != nil {
+			panic(err)
+		}
+		addSensors(child, childConfig.Sensors)
+		addBinarySensors(child, childConfig.BinarySensors)
 	}
 	// Print the sensors information
 	// for _, sensor := range device.GetSensors() {
 	// 	fmt.Printf("%+v\n", sensor.config)
 	// }
-	fmt.Println(">> Device and sensors created successfully.")
+	device.Start()
+	slog.Debug("Device and sensors created")
 
-	// create the MQTT server proxy
-	fmt.Println(">> Creating MQTT server proxy...")
-	MQTTServer := NewMQTTProxy(config.MQTTServer.IP, config.MQTTServer.Port, config.MQTTServer.Username, config.MQTTServer.Password)
-	fmt.Println(">> MQTT server proxy created successfully.")
+	// Home Assistant is reached through the MQTT server, unless it is not configured
+	var sinks []Sink
+	if config.MQTTServer.IP != "" {
+		MQTTServer := NewMQTTProxy(config.MQTTServer.IP, config.MQTTServer.Port, config.MQTTServer.Username, config.MQTTServer.Password)
+		// Home Assistant shows the entities as unavailable once the agent is gone
+		MQTTServer.SetAvailability(GetAvailabilityTopic(device))
+		sinks = append(sinks, NewMQTTSink(MQTTServer))
+	}
+	for _, sinkConfig := range config.Sinks {
+		sink, err := NewSinkFromConfig(sinkConfig)
+		if err != nil {
+			panic(err)
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(sinks) == 0 {
+		panic("no destination configured, set mqtt_server or sinks")
+	}
+
+	// Expose the sensors to Prometheus, independently of the sinks
+	var observers []Observer
+	if config.PrometheusExporter != nil {
+		exporter, err := NewPrometheusExporter(*config.PrometheusExporter)
+		if err != nil {
+			panic(err)
+		}
+		exporter.Start()
+		observers = append(observers, exporter)
+		slog.Info("Serving Prometheus metrics", "address", config.PrometheusExporter.Listen, "path", exporter.path)
+	}
+	// Show what the agent sees on the local status API
+	if config.StatusAPI != nil {
+		status, err := NewStatusServer(*config.StatusAPI, device, config.Software.RefreshPeriodS)
+		if err != nil {
+			panic(err)
+		}
+		status.Start()
+		observers = append(observers, status)
+		slog.Info("Serving the status API", "address", config.StatusAPI.Listen)
+	}
 
-	fmt.Println(">> Software configured successfully.")
+	// Run the main loop until SIGTERM or SIGINT
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	// The commands and the requests of the cycles are only stopped when the
+	// running cycle does not end within the grace period
+	work, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
+	// SIGHUP enumerates the hardware of the autodiscovery again
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	slog.Info("Running", "sinks", len(sinks), "refresh_period_s", config.Software.RefreshPeriodS)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		run(ctx, work, device, sinks, observers, config.Software.RefreshPeriodS, hangups)
+	}()
+	<-ctx.Done()
+	// A second signal kills the agent
+	stop()
 
-	// Run the main loop
-	fmt.Println(">> Running...")
-	run(device, MQTTServer, config.Software.RefreshPeriodS)
+	slog.Info("Stopping, waiting for the running cycle", "grace_period", SHUTDOWN_GRACE_PERIOD)
+	select {
+	case <-done:
+	case <-time.After(SHUTDOWN_GRACE_PERIOD):
+		slog.Warn("Running cycle did not end in time, stopping its commands and requests", "grace_period", SHUTDOWN_GRACE_PERIOD)
+		cancelWork()
+		<-done
+	}
+	shutdown(device, sinks, observers)
+	slog.Info("Stopped")
 }
 
-func run(device *Device, MQTTServer *MQTTProxy, refreshPeriod int) {
+// shutdown stops the background work of the device, closes the sinks, which
+// disconnects from the MQTT server and announces the agent as offline, and stops
+// the observers.
+func shutdown(device *Device, sinks []Sink, observers []Observer) {
+	device.Stop()
+	for _, sink := range sinks {
+		if closer, ok := sink.(interface{ Close() }); ok {
+			closer.Close()
+		}
+	}
+	for _, observer := range observers {
+		observer.Stop()
+	}
+}
 
-	// Format the MQTT config payload
-	mqttConfig, err := FormatMQTTConfig(device)
-	if err != nil {
-		panic(err)
+// addSensors creates the sensors of the configuration file for the device. Nagios
+// checks publish a variable number of entities, they are collected like plugins.
+// It panics if a sensor is invalid.
+func addSensors(device *Device, sensors []SensorConfig) {
+	for _, sensorConfig := range sensors {
+		if sensorConfig.Type == SENSOR_TYPE_NAGIOS {
+			check, err := NewNagiosCheck(sensorConfig)
+			if err != nil {
+				panic(err)
+			}
+			device.AddCollector(check)
+			continue
+		}
+		sensor, err := NewSensorFromConfig(sensorConfig, device)
+		if err != nil {
+			panic(err)
+		}
+		device.AddSensor(sensor)
+		for _, linked := range sensor.GetLinkedSensors() {
+			device.AddSensor(linked)
+		}
 	}
+}
 
-	lastConfigSent := time.Date(2020, 10, 26, 0, 0, 0, 0, time.UTC)
-	for {
+// addBinarySensors creates the binary sensors of the configuration file for the
+// device, once its sensors exist. It panics if a binary sensor is invalid.
+func addBinarySensors(device *Device, binarySensors []BinarySensorConfig) {
+	for _, binarySensorConfig := range binarySensors {
+		sensor, err := NewBinarySensorFromConfig(binarySensorConfig, device)
+		if err != nil {
+			panic(err)
+		}
+		device.AddSensor(sensor)
+	}
+}
+
+// Observer is informed of the progress of the main loop, such as the Prometheus
+// exporter or the status API. Its methods are called by the main loop only.
+type Observer interface {
+	// Update records the readings of a snapshot, partial for the stream sensors.
+	Update(device *Device, snapshot *Snapshot)
+	// RecordCycle records the end of a collection cycle.
+	RecordCycle(start time.Time, duration time.Duration)
+	// SetSinkStatus records the result of the last publication to a sink.
+	SetSinkStatus(sink Sink, err error)
+	// Stop stops the observer once the main loop ended.
+	Stop()
+}
+
+// run collects and publishes the readings every refresh period until the context
+// is cancelled. A cycle or a command already running is completed, and the new
+// readings of the stream sensors are published before returning. The commands
+// and the requests of the cycles run with the work context, whose cancellation
+// aborts them. The hardware of the autodiscovery is enumerated again on every
+// hangup.
+func run(ctx context.Context, work context.Context, device *Device, sinks []Sink, observers []Observer, refreshPeriod int, hangups <-chan os.Signal) {
+	period := time.Duration(refreshPeriod) * time.Second
+	for ctx.Err() == nil {
 		func() {
 			//If an error occurs, wait for 2 mins before trying again
 			defer func() {
 				if r := recover(); r != nil {
-					fmt.Println(">>> Recovered in run:", r)
-					fmt.Println(">>> Waiting for 2 minutes before retrying...")
-					time.Sleep(RETRY_PAUSE)
+					slog.Error("Recovered in run, retrying after a pause", "error", r, "pause", RETRY_PAUSE)
+					select {
+					case <-ctx.Done():
+					case <-time.After(RETRY_PAUSE):
+					}
 				}
 			}()
 
-			// Connect to the MQTT server
-			err := MQTTServer.Connect()
+			start := time.Now()
+			snapshot, err := device.Collect(work)
 			if err != nil {
-				panic(err)
+				slog.Error("Error saving sensor state", "error", err)
 			}
-			fmt.Println("> Connected to the MQTT server.")
-
-			// Send configuration to the MQTT server if 15 minutes have elapsed
-			if time.Since(lastConfigSent) > CONFIG_REFRESH_PERIOD {
-				fmt.Println("> Sending configuration to the MQTT server...")
-
-				err = MQTTServer.Publish(GetConfigTopic(device), mqttConfig)
-				if err != nil {
-					panic(err)
-				}
-				fmt.Println("> Configuration sent to the MQTT server.")
-				lastConfigSent = time.Now()
+			// The readings of an aborted cycle are only errors
+			if work.Err() != nil {
+				return
 			}
-
-			fmt.Println("> Getting sensor values...")
-			for _, sensor := range device.GetSensors() {
-				val, err := sensor.GetSensorValue()
-				if err != nil {
-					fmt.Println("Error getting sensor value:", err)
-					continue
+			for _, dev := range device.Devices() {
+				readings := snapshot.Of(dev).Readings
+				for _, sensor := range dev.GetSensors() {
+					if sensor.IsEvent() || sensor.IsButton() {
+						continue
+					}
+					reading := readings[sensor.Key()]
+					if errors.Is(reading.Err, ErrNoValue) {
+						slog.Debug("Sensor waiting for more samples", "sensor", sensor.Key(), "device", dev.GetDeviceInfo().Name)
+						continue
+					}
+					if reading.Err != nil {
+						slog.Warn("Error getting sensor value", "sensor", sensor.Key(), "device", dev.GetDeviceInfo().Name, "error", reading.Err)
+						continue
+					}
+					slog.Debug("Sensor value", "sensor", sensor.Key(), "device", dev.GetDeviceInfo().Name, "value", reading.Value, "duration", reading.Duration)
 				}
-				fmt.Println("Sensor : ", sensor.config.Name, " - value:", val)
 			}
-			fmt.Println("> Sensor values retrieved successfully.")
-
-			// Format the MQTT values payload
-			fmt.Println("> Sending sensor values to the MQTT server...")
-			mqttValues, err := FormatMQTTValues(device)
-			if err != nil {
-				panic(err)
+			slog.Info("Sensor values collected", "duration", time.Since(start))
+			for _, observer := range observers {
+				observer.RecordCycle(start, time.Since(start))
 			}
 
-			// Publish sensor values to the MQTT server
-			err = MQTTServer.Publish(GetStateTopic(device), mqttValues)
-			if err != nil {
-				panic(err)
+			publish(work, period, device, sinks, observers, snapshot)
+
+			// Wait for the next cycle, publishing the lines of the stream sensors as they come
+			next := time.After(period)
+			for {
+				select {
+				case <-ctx.Done():
+					// Flush the readings not published yet
+					for _, snapshot := range device.CollectStreams() {
+						publish(work, period, device, sinks, observers, snapshot)
+					}
+					return
+				case <-next:
+					return
+				case <-hangups:
+					added, removed, err := device.ReloadDiscoveredSensors()
+					if err != nil {
+						slog.Error("Error reloading the hardware autodiscovery", "error", err)
+						continue
+					}
+					slog.Info("Hardware autodiscovery reloaded", "added", added, "removed", removed)
+				case <-device.CollectionRequests():
+					slog.Info("Collection requested")
+					return
+				case <-device.Updates():
+					for _, snapshot := range device.CollectStreams() {
+						publish(work, period, device, sinks, observers, snapshot)
+					}
+				case command := <-device.Commands():
+					if err := device.HandleCommand(work, command); err != nil {
+						slog.Error("Error executing command", "topic", command.topic, "error", err)
+					}
+				}
 			}
-			fmt.Println("> Sensor values sent to the MQTT server.")
+		}()
+	}
+}
 
-			// Sleep for a defined interval before the next iteration
-			time.Sleep(time.Duration(refreshPeriod) * time.Second) // Adjust the interval as needed
+// publish hands a snapshot to the observers and to every sink. The sinks publish
+// concurrently and fail independently: a slow sink does not delay the others, and
+// its publication is abandoned once the deadline expires so that the next cycle
+// starts on time. The error of a sink is reported and the next snapshot is handed
+// to it again.
+func publish(ctx context.Context, deadline time.Duration, device *Device, sinks []Sink, observers []Observer, snapshot *Snapshot) {
+	for _, observer := range observers {
+		observer.Update(device, snapshot)
+	}
+	// The snapshots of the children are created on first access, not by the sinks
+	for _, dev := range device.Devices() {
+		snapshot.Of(dev)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, deadline)
+	defer cancel()
+	errs := make([]error, len(sinks))
+	var wg sync.WaitGroup
+	for i, sink := range sinks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// A panicking sink fails alone, like an erroring one
+			defer func() {
+				if r := recover(); r != nil {
+					errs[i] = fmt.Errorf("panic: %v", r)
+				}
+			}()
+			errs[i] = sink.Publish(ctx, device, snapshot)
 		}()
 	}
+	wg.Wait()
+
+	for i, sink := range sinks {
+		if errs[i] != nil {
+			slog.Warn("Error publishing", "sink", sink.Name(), "error", errs[i])
+		}
+		for _, observer := range observers {
+			observer.SetSinkStatus(sink, errs[i])
+		}
+	}
 }
@@ -1,11 +1,24 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/eclipse/paho.mqtt.golang"
 )
 
+const (
+	PAYLOAD_ONLINE  = "online"
+	PAYLOAD_OFFLINE = "offline"
+
+	// DISCONNECT_TIMEOUT is the time given to the offline announcement before disconnecting.
+	DISCONNECT_TIMEOUT = 2 * time.Second
+)
+
 // mqttConfig represents the configuration required to connect to an MQTT broker.
 // It includes the following fields:
 // - IP: The IP address of the MQTT broker.
@@ -23,15 +36,21 @@ type mqttConfig struct {
 // It provides functionality to maintain the connection state, client options, and the MQTT client instance.
 //
 // Fields:
-// - IsConnected: A boolean indicating whether the MQTT client is currently connected.
+// - connected: A private field telling whether the MQTT client is currently connected, set by the client's goroutine.
 // - config: A private field containing the configuration details for the MQTT client.
 // - opts: A private field holding the MQTT client options.
 // - client: A private field representing the MQTT client instance.
+// - subscriptions: A private field holding the subscribed topics and their callbacks, restored on reconnection.
+// - mu: A private field guarding the subscriptions, restored by the client's goroutine.
+// - availabilityTopic: A private field holding the topic telling whether the agent is online, if any.
 type MQTTProxy struct {
-	IsConnected bool
-	config      *mqttConfig
-	opts        *mqtt.ClientOptions
-	client      mqtt.Client
+	connected         atomic.Bool
+	config            *mqttConfig
+	opts              *mqtt.ClientOptions
+	client            mqtt.Client
+	subscriptions     map[string]mqtt.MessageHandler
+	mu                sync.Mutex
+	availabilityTopic string
 }
 
 // NewMQTTProxy creates a new instance of MQTTProxy with the specified configuration.
@@ -48,15 +67,15 @@ type MQTTProxy struct {
 //	A pointer to an initialized MQTTProxy instance.
 func NewMQTTProxy(ip string, port string, username string, password string) *MQTTProxy {
 	return &MQTTProxy{
-		IsConnected: false,
 		config: &mqttConfig{
 			IP:       ip,
 			Port:     port,
 			Username: username,
 			Password: password,
 		},
-		opts:   nil,
-		client: nil,
+		opts:          nil,
+		client:        nil,
+		subscriptions: map[string]mqtt.MessageHandler{},
 	}
 }
 
@@ -66,12 +85,14 @@ func NewMQTTProxy(ip string, port string, username string, password string) *MQT
 //
 // The method sets up client options, including the broker address, username,
 // password, and auto-reconnect behavior. It also defines a callback to handle
-// connection loss, which updates the connection status and logs the error.
+// connection loss, which updates the connection status and logs the error, and
+// a callback restoring the subscriptions every time the client (re)connects.
 //
-// Returns an error if the connection attempt fails; otherwise, it updates the
-// IsConnected field to true upon successful connection.
-func (m *MQTTProxy) Connect() error {
-	if m.IsConnected {
+// Returns an error if the connection attempt fails or the context is cancelled
+// first, in which case the attempt is abandoned; otherwise, the proxy is marked
+// as connected.
+func (m *MQTTProxy) Connect(ctx context.Context) error {
+	if m.connected.Load() {
 		return nil
 	}
 	m.opts = mqtt.NewClientOptions()
@@ -79,52 +100,107 @@ func (m *MQTTProxy) Connect() error {
 	m.opts.SetUsername(m.config.Username)
 	m.opts.SetPassword(m.config.Password)
 	m.opts.AutoReconnect = true
+	// The server announces that the agent is offline when its connection is lost
+	if m.availabilityTopic != "" {
+		m.opts.SetWill(m.availabilityTopic, PAYLOAD_OFFLINE, 1, true)
+	}
 
 	// Set the OnConnectionLost callback
 	m.opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
-		fmt.Printf("Connection lost: %v\n", err)
-		m.IsConnected = false
+		slog.Warn("Connection to the MQTT server lost", "error", err)
+		m.connected.Store(false)
+	})
+	m.opts.SetOnConnectHandler(func(client mqtt.Client) {
+		// Also called when the client reconnects on its own
+		m.connected.Store(true)
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for topic, callback := range m.subscriptions {
+			if token := client.Subscribe(topic, 0, callback); token.Wait() && token.Error() != nil {
+				slog.Error("Error subscribing", "topic", topic, "error", token.Error())
+			}
+		}
+		if m.availabilityTopic != "" {
+			if token := client.Publish(m.availabilityTopic, 1, true, PAYLOAD_ONLINE); token.Wait() && token.Error() != nil {
+				slog.Error("Error publishing the availability", "topic", m.availabilityTopic, "error", token.Error())
+			}
+		}
 	})
 
 	m.client = mqtt.NewClient(m.opts)
 
-	if token := m.client.Connect(); token.Wait() && token.Error() != nil {
+	token := m.client.Connect()
+	select {
+	case <-token.Done():
+	case <-ctx.Done():
+		// Stop the connection attempt, which would otherwise go on in the background
+		m.client.Disconnect(0)
+		return ctx.Err()
+	}
+	if token.Error() != nil {
 		return token.Error()
 	}
 
-	m.IsConnected = true
+	m.connected.Store(true)
 	return nil
 }
 
+// SetAvailability sets the topic telling whether the agent is online. Once connected,
+// the proxy publishes "online" on it, and "offline" when it disconnects. The server
+// publishes "offline" itself when the connection is lost. It must be called before
+// Connect.
+//
+// Parameters:
+//   - topic: The availability topic.
+func (m *MQTTProxy) SetAvailability(topic string) {
+	m.availabilityTopic = topic
+}
+
 // Disconnect gracefully disconnects the MQTT client if it is currently connected.
-// It waits for up to 250 milliseconds to ensure any pending operations are completed
-// before closing the connection. After disconnecting, it updates the IsConnected
-// flag to false.
+// It announces that the agent is offline first, then waits for up to 250 milliseconds
+// to ensure any pending operations are completed before closing the connection.
+// After disconnecting, the proxy is marked as disconnected.
 func (m *MQTTProxy) Disconnect() {
-	if m.IsConnected {
+	if m.connected.Load() {
+		if m.availabilityTopic != "" {
+			token := m.client.Publish(m.availabilityTopic, 1, true, PAYLOAD_OFFLINE)
+			if !token.WaitTimeout(DISCONNECT_TIMEOUT) || token.Error() != nil {
+				slog.Warn("Error publishing the availability", "topic", m.availabilityTopic, "error", token.Error())
+			}
+		}
 		m.client.Disconnect(250)
-		m.IsConnected = false
+		m.connected.Store(false)
 	}
 }
 
+// IsConnected reports whether the MQTT client is currently connected.
+func (m *MQTTProxy) IsConnected() bool {
+	return m.connected.Load()
+}
+
 // Publish sends a message with the specified payload to the given MQTT topic.
 // It ensures that the MQTT client is connected before attempting to publish.
 // If the client is not connected, or if an error occurs during publishing,
 // an error is returned.
 //
 // Parameters:
+//   - ctx: Stops waiting for the publication when cancelled.
 //   - topic: The MQTT topic to which the message will be published.
 //   - payload: The message content to be published.
 //
 // Returns:
 //   - error: An error if the client is not connected or if the publish operation fails.
-func (m *MQTTProxy) Publish(topic string, payload string) error {
-	if !m.IsConnected {
+func (m *MQTTProxy) Publish(ctx context.Context, topic string, payload string) error {
+	if !m.connected.Load() {
 		return fmt.Errorf("not connected to MQTT broker")
 	}
 
 	token := m.client.Publish(topic, 0, false, payload)
-	token.Wait()
+	select {
+	case <-token.Done():
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 
 	if token.Error() != nil {
 		return token.Error()
@@ -137,6 +213,7 @@ func (m *MQTTProxy) Publish(topic string, payload string) error {
 // to handle incoming messages on that topic.
 //
 // Parameters:
+//   - ctx: Stops waiting for the subscription when cancelled.
 //   - topic: The MQTT topic to subscribe to.
 //   - callback: A function of type mqtt.MessageHandler that will be invoked
 //     whenever a message is received on the subscribed topic.
@@ -147,18 +224,26 @@ func (m *MQTTProxy) Publish(topic string, payload string) error {
 // Notes:
 //   - The function checks if the MQTT client is connected before attempting to subscribe.
 //   - The callback function is executed for each message received on the subscribed topic.
-func (m *MQTTProxy) Subscribe(topic string, callback mqtt.MessageHandler) error {
-	if !m.IsConnected {
+//   - The subscription is restored when the client reconnects.
+func (m *MQTTProxy) Subscribe(ctx context.Context, topic string, callback mqtt.MessageHandler) error {
+	if !m.connected.Load() {
 		return fmt.Errorf("not connected to MQTT broker")
 	}
 
 	token := m.client.Subscribe(topic, 0, callback)
-	token.Wait()
+	select {
+	case <-token.Done():
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 
 	if token.Error() != nil {
 		return token.Error()
 	}
 
+	m.mu.Lock()
+	m.subscriptions[topic] = callback
+	m.mu.Unlock()
 	return nil
 }
 
@@ -168,21 +253,29 @@ func (m *MQTTProxy) Subscribe(topic string, callback mqtt.MessageHandler) error
 // If the unsubscription process encounters an error, it returns the error.
 //
 // Parameters:
+//   - ctx: Stops waiting for the unsubscription when cancelled.
 //   - topic: The MQTT topic to unsubscribe from.
 //
 // Returns:
 //   - error: An error if the client is not connected or if the unsubscription fails; otherwise, nil.
-func (m *MQTTProxy) Unsubscribe(topic string) error {
-	if !m.IsConnected {
+func (m *MQTTProxy) Unsubscribe(ctx context.Context, topic string) error {
+	if !m.connected.Load() {
 		return fmt.Errorf("not connected to MQTT broker")
 	}
 
 	token := m.client.Unsubscribe(topic)
-	token.Wait()
+	select {
+	case <-token.Done():
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 
 	if token.Error() != nil {
 		return token.Error()
 	}
 
+	m.mu.Lock()
+	delete(m.subscriptions, topic)
+	m.mu.Unlock()
 	return nil
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMQTTProxyConnectCancelled(t *testing.T) {
+	// The server accepts the connection but never acknowledges it
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	proxy := NewMQTTProxy(host, port, "", "")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := proxy.Connect(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Connect() = %v, want the error of the context", err)
+	}
+	if proxy.IsConnected() {
+		t.Error("proxy connected after a cancelled connection")
+	}
+	if proxy.client.IsConnectionOpen() {
+		t.Error("connection attempt not abandoned")
+	}
+	if err := proxy.Subscribe(context.Background(), "topic", nil); err == nil {
+		t.Error("Subscribe() succeeded without connection")
+	}
+}
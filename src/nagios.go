@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SENSOR_TYPE_COMMAND = "command"
+	SENSOR_TYPE_NAGIOS  = "nagios"
+
+	// DEFAULT_NAGIOS_TIMEOUT is the time a check is given to complete, the
+	// default timeout of the Monitoring Plugins.
+	DEFAULT_NAGIOS_TIMEOUT = 10 * time.Second
+)
+
+// nagiosStatuses maps the exit codes of a check to the state of its status entity.
+var nagiosStatuses = []string{"ok", "warning", "critical", "unknown"}
+
+// nagiosUnits maps the units of the performance data to the unit and device class
+// of their entities in Home Assistant.
+var nagiosUnits = map[string]struct {
+	unit        string
+	deviceClass string
+}{
+	"s":  {"s", "duration"},
+	"ms": {"ms", "duration"},
+	"us": {"μs", "duration"},
+	"%":  {"%", ""},
+	"B":  {"B", "data_size"},
+	"KB": {"kB", "data_size"},
+	"MB": {"MB", "data_size"},
+	"GB": {"GB", "data_size"},
+	"TB": {"TB", "data_size"},
+}
+
+// perfdataPattern matches a single performance data item:
+// 'label'=value[UOM];[warn];[crit];[min];[max]
+var perfdataPattern = regexp.MustCompile(`^('(?:[^']|'')+'|[^=\s]+)=(\S+)`)
+
+// perfdataValuePattern splits the value of a performance data item from its unit.
+var perfdataValuePattern = regexp.MustCompile(`^(-?[0-9.]+(?:[eE][-+]?[0-9]+)?|U)([a-zA-Z%]*)$`)
+
+// nagiosOutput represents the parsed output of a check.
+//
+// Fields:
+// - text: The status text, the first line of the output.
+// - longText: The following lines of the output, without performance data.
+// - perfdata: The performance data items.
+type nagiosOutput struct {
+	text     string
+	longText string
+	perfdata []perfdataItem
+}
+
+// perfdataItem represents a single item of the performance data of a check.
+// The value is nil when the check reported it as undetermined ("U").
+type perfdataItem struct {
+	label    string
+	value    *float64
+	unit     string
+	warn     string
+	crit     string
+	min      string
+	max      string
+	counting bool
+}
+
+// parseNagiosOutput parses the output of a Monitoring-Plugins-compatible check:
+//
+//	TEXT OUTPUT | OPTIONAL PERFDATA
+//	LONG TEXT LINE 1
+//	LONG TEXT LINE 2 | PERFDATA LINE 2
+//	PERFDATA LINE 3
+func parseNagiosOutput(output string) (nagiosOutput, error) {
+	var result nagiosOutput
+	lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+
+	text, perfdata, _ := strings.Cut(lines[0], "|")
+	result.text = strings.TrimSpace(text)
+	perfdataParts := []string{perfdata}
+
+	var longText []string
+	inPerfdata := false
+	for _, line := range lines[1:] {
+		if inPerfdata {
+			perfdataParts = append(perfdataParts, line)
+			continue
+		}
+		text, perfdata, found := strings.Cut(line, "|")
+		longText = append(longText, text)
+		if found {
+			perfdataParts = append(perfdataParts, perfdata)
+			inPerfdata = true
+		}
+	}
+	result.longText = strings.TrimSpace(strings.Join(longText, "\n"))
+
+	items, err := parsePerfdata(strings.Join(perfdataParts, " "))
+	if err != nil {
+		return result, err
+	}
+	result.perfdata = items
+	return result, nil
+}
+
+// parsePerfdata parses space separated performance data items.
+func parsePerfdata(perfdata string) ([]perfdataItem, error) {
+	var items []perfdataItem
+	rest := strings.TrimSpace(perfdata)
+	for rest != "" {
+		match := perfdataPattern.FindStringSubmatch(rest)
+		if match == nil {
+			return nil, fmt.Errorf("invalid performance data %q", rest)
+		}
+		rest = strings.TrimSpace(rest[len(match[0]):])
+
+		label := match[1]
+		if strings.HasPrefix(label, "'") {
+			label = strings.ReplaceAll(label[1:len(label)-1], "''", "'")
+		}
+		fields := strings.Split(match[2], ";")
+		for len(fields) < 5 {
+			fields = append(fields, "")
+		}
+
+		valueMatch := perfdataValuePattern.FindStringSubmatch(fields[0])
+		if valueMatch == nil {
+			return nil, fmt.Errorf("invalid performance data value %q for %q", fields[0], label)
+		}
+		item := perfdataItem{
+			label: label,
+			unit:  valueMatch[2],
+			warn:  fields[1],
+			crit:  fields[2],
+			min:   fields[3],
+			max:   fields[4],
+		}
+		if valueMatch[1] != "U" {
+			value, err := strconv.ParseFloat(valueMatch[1], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid performance data value %q for %q", fields[0], label)
+			}
+			item.value = &value
+		}
+		if item.unit == "c" {
+			item.counting = true
+			item.unit = ""
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// NagiosCheck is a Collector running a Monitoring-Plugins-compatible check.
+// It publishes the status of the check as an enum entity, with the status text
+// as attributes, and every performance data item as a numeric entity.
+//
+// Fields:
+// - name: The name of the status entity, and prefix of the performance data entities.
+// - command: The command running the check.
+// - icon: The icon of the status entity.
+// - timeout: The time the check is given to complete.
+type NagiosCheck struct {
+	name    string
+	command string
+	icon    string
+	timeout time.Duration
+}
+
+// NewNagiosCheck creates a new check from its sensor entry in the configuration file.
+//
+// Parameters:
+//   - cfg: The sensor entry of the configuration file, of type nagios.
+//
+// Returns:
+//   - A pointer to the newly created NagiosCheck instance.
+//   - An error if the configuration is invalid.
+func NewNagiosCheck(cfg SensorConfig) (*NagiosCheck, error) {
+	if cfg.Name == "" || cfg.Command == "" {
+		return nil, fmt.Errorf("nagios sensors need a name and a command")
+	}
+	if cfg.TimeoutS < 0 {
+		return nil, fmt.Errorf("sensor %q: timeout must not be negative", cfg.Name)
+	}
+	timeout := DEFAULT_NAGIOS_TIMEOUT
+	if cfg.TimeoutS > 0 {
+		timeout = time.Duration(cfg.TimeoutS) * time.Second
+	}
+	return &NagiosCheck{
+		name:    cfg.Name,
+		command: cfg.Command,
+		icon:    cfg.Icon,
+		timeout: timeout,
+	}, nil
+}
+
+// Name returns the name of the check.
+func (c *NagiosCheck) Name() string {
+	return c.name
+}
+
+// Collect runs the check and returns its status and performance data entities.
+// A check which times out is reported as unknown, like a Monitoring Plugin would.
+func (c *NagiosCheck) Collect(ctx context.Context) ([]CollectedEntity, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	cmd := shellCommand(ctx, c.command)
+	cmd.WaitDelay = time.Second
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	err := cmd.Run()
+	code := exitCode(err)
+	if code == -1 && ctx.Err() == nil {
+		return nil, err
+	}
+
+	output, parseErr := parseNagiosOutput(stdout.String())
+	if ctx.Err() != nil {
+		code = 3
+		output = nagiosOutput{text: fmt.Sprintf("UNKNOWN - check timed out after %s", c.timeout)}
+	}
+	if code < 0 || code >= len(nagiosStatuses) {
+		code = 3
+	}
+
+	attributes := map[string]any{
+		"status_text": output.text,
+		"exit_code":   code,
+	}
+	if output.longText != "" {
+		attributes["long_output"] = output.longText
+	}
+	if parseErr != nil {
+		attributes["perfdata_error"] = parseErr.Error()
+	}
+	entities := []CollectedEntity{{
+		Name:        c.name,
+		Value:       nagiosStatuses[code],
+		DeviceClass: "enum",
+		Icon:        c.icon,
+		Attributes:  attributes,
+	}}
+
+	// Labels without letters nor digits, such as the / of check_disk, would share
+	// the key of the status, they are numbered like the autodiscovered sensors
+	keys := map[string]bool{sensorKey(c.name): true}
+	for _, item := range output.perfdata {
+		name := c.name + " " + item.label
+		for count := 2; keys[sensorKey(name)]; count++ {
+			name = fmt.Sprintf("%s %s %d", c.name, item.label, count)
+		}
+		keys[sensorKey(name)] = true
+		entity := CollectedEntity{
+			Name:       name,
+			StateClass: "measurement",
+			Unit:       item.unit,
+			Attributes: map[string]any{},
+		}
+		if item.value != nil {
+			entity.Value = *item.value
+		}
+		if known, ok := nagiosUnits[item.unit]; ok {
+			entity.Unit = known.unit
+			entity.DeviceClass = known.deviceClass
+		}
+		if item.counting {
+			entity.StateClass = "total_increasing"
+		}
+		for key, value := range map[string]string{"warning": item.warn, "critical": item.crit, "min": item.min, "max": item.max} {
+			if value != "" {
+				entity.Attributes[key] = value
+			}
+		}
+		entities = append(entities, entity)
+	}
+	return entities, nil
+}
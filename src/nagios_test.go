@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestNagiosCheckMountPointLabels(t *testing.T) {
+	// The output of check_disk -w 20% -c 10% -p / -p /home
+	check, err := NewNagiosCheck(SensorConfig{
+		Name:    "Check Root Disk",
+		Type:    SENSOR_TYPE_NAGIOS,
+		Command: `echo "DISK OK - free space: / 3326 MB (56% inode=90%); /home 880 MB (88% inode=99%);| /=2643MB;3948;4441;0;4935 /home=120MB;800;900;0;1000"`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := NewDevice("Host", "Manufacturer", "Model", "host-sn")
+	device.AddCollector(check)
+	snapshot, err := device.Collect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := FormatMQTTConfig(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var discovery autoDiscoveryDeviceMQTT
+	if err := json.Unmarshal([]byte(config), &discovery); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]any{
+		"check_root_disk":      "ok",
+		"check_root_disk_2":    2643.0,
+		"check_root_disk_home": 120.0,
+	} {
+		reading, ok := snapshot.Readings[key]
+		if !ok {
+			t.Errorf("no reading for %q in %v", key, snapshot.Readings)
+			continue
+		}
+		if reading.Value != want {
+			t.Errorf("%s = %v, want %v", key, reading.Value, want)
+		}
+		component, ok := discovery.Components[key]
+		if !ok {
+			t.Errorf("no %q component in %s", key, config)
+			continue
+		}
+		if component.ValueTemplate != "{{ value_json."+key+" }}" {
+			t.Errorf("value_template of %s = %q", key, component.ValueTemplate)
+		}
+	}
+	if sensor := device.GetSensorByName("Check Root Disk / 2"); sensor == nil || sensor.config.UnitOfMeasurement != "MB" {
+		t.Errorf("the / item is not a sensor in MB named after the check")
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PLUGIN_MODE_EXEC       = "exec"
+	PLUGIN_MODE_PERSISTENT = "persistent"
+
+	// PLUGIN_MIN_BACKOFF and PLUGIN_MAX_BACKOFF bound the delay before restarting
+	// a persistent plugin which crashed. The delay doubles after each crash.
+	PLUGIN_MIN_BACKOFF = time.Second
+	PLUGIN_MAX_BACKOFF = 5 * time.Minute
+	// PLUGIN_STOP_GRACE is the time a persistent plugin is given to exit once its
+	// standard input is closed, before being killed.
+	PLUGIN_STOP_GRACE = 5 * time.Second
+	// PLUGIN_STDERR_LINES is the number of error output lines of a persistent
+	// plugin kept to explain its failures.
+	PLUGIN_STDERR_LINES = 10
+)
+
+// pluginRequest represents a request sent to a persistent plugin.
+type pluginRequest struct {
+	Type string `json:"type"`
+	ID   int    `json:"id"`
+}
+
+// pluginResponse represents a response of a persistent plugin. It is the same
+// document as the one printed by exec plugins, with the identifier of the
+// request and an optional error.
+type pluginResponse struct {
+	ID    *int   `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// pluginProcess represents a running persistent plugin.
+//
+// Fields:
+// - cmd: The process of the plugin.
+// - stdin: The standard input of the plugin, where requests are written.
+// - lines: The lines printed by the plugin on its standard output.
+// - discard: Closed once the lines are no longer received, they are then dropped.
+// - exited: Closed once the process exited and its outputs were read.
+// - err: The exit error of the process, valid once exited is closed.
+type pluginProcess struct {
+	cmd         *exec.Cmd
+	stdin       io.WriteCloser
+	lines       chan []byte
+	discard     chan struct{}
+	discardOnce sync.Once
+	exited      chan struct{}
+	err         error
+}
+
+// stopReceiving makes the reader of the standard output drop the lines instead of
+// waiting for them to be received, so that it reads until the process exits.
+func (p *pluginProcess) stopReceiving() {
+	p.discardOnce.Do(func() {
+		close(p.discard)
+	})
+}
+
+// PersistentPlugin is a Collector starting its plugin once and exchanging JSON
+// lines with it: a `{"type": "collect"}` request is written on the standard input
+// of the plugin at every cycle, and the plugin answers with its document on a
+// single line of its standard output. The plugin is restarted with an increasing
+// backoff when it crashes, and killed when it misses the deadline of a request.
+//
+// Fields:
+// - name: The name of the plugin.
+// - command: The command starting the plugin.
+// - timeout: The deadline of a request.
+// - process: The running plugin, or nil if it is not running.
+// - nextID: The identifier of the next request.
+// - backoff: The delay before the next restart.
+// - nextStart: The time before which the plugin is not restarted.
+// - stderr: The last lines of the error output of the plugin.
+type PersistentPlugin struct {
+	name    string
+	command string
+	timeout time.Duration
+
+	process   *pluginProcess
+	nextID    int
+	backoff   time.Duration
+	nextStart time.Time
+
+	stderrMu sync.Mutex
+	stderr   []string
+}
+
+// NewPersistentPlugin creates a new persistent plugin from its configuration
+// file entry. The plugin is started by the first collection.
+//
+// Parameters:
+//   - cfg: The plugin entry of the configuration file.
+//
+// Returns:
+//   - A pointer to the newly created PersistentPlugin instance.
+//   - An error if the configuration is invalid.
+func NewPersistentPlugin(cfg PluginConfig) (*PersistentPlugin, error) {
+	plugin, err := NewExecPlugin(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &PersistentPlugin{
+		name:    plugin.name,
+		command: plugin.command,
+		timeout: plugin.timeout,
+		backoff: PLUGIN_MIN_BACKOFF,
+	}, nil
+}
+
+// NewPluginFromConfig creates the collector of a plugin according to its mode.
+func NewPluginFromConfig(cfg PluginConfig) (Collector, error) {
+	switch cfg.Mode {
+	case "", PLUGIN_MODE_EXEC:
+		return NewExecPlugin(cfg)
+	case PLUGIN_MODE_PERSISTENT:
+		return NewPersistentPlugin(cfg)
+	}
+	return nil, fmt.Errorf("plugin %q: unknown mode %q", cfg.Name, cfg.Mode)
+}
+
+// Name returns the name of the plugin.
+func (p *PersistentPlugin) Name() string {
+	return p.name
+}
+
+// Collect sends a collect request to the plugin, starting it if needed, and
+// returns the entities of its response.
+func (p *PersistentPlugin) Collect(ctx context.Context) ([]CollectedEntity, error) {
+	if p.process == nil {
+		if time.Now().Before(p.nextStart) {
+			return nil, fmt.Errorf("plugin crashed, restarting in %s", time.Until(p.nextStart).Round(time.Millisecond))
+		}
+		if err := p.start(); err != nil {
+			p.scheduleRestart()
+			return nil, err
+		}
+	}
+
+	p.nextID++
+	request, err := json.Marshal(pluginRequest{Type: "collect", ID: p.nextID})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.process.stdin.Write(append(request, '\n')); err != nil {
+		return nil, p.crashed(err)
+	}
+
+	deadline := time.NewTimer(p.timeout)
+	defer deadline.Stop()
+	for {
+		select {
+		case line, ok := <-p.process.lines:
+			if !ok {
+				<-p.process.exited
+				return nil, p.crashed(p.process.err)
+			}
+			var response pluginResponse
+			if err := json.Unmarshal(line, &response); err != nil {
+				return nil, fmt.Errorf("invalid plugin response: %w", err)
+			}
+			// Skip the late responses to previous requests
+			if response.ID != nil && *response.ID != p.nextID {
+				continue
+			}
+			if response.Error != "" {
+				return nil, errors.New(response.Error)
+			}
+			// A successful response proves that the plugin is healthy again
+			p.backoff = PLUGIN_MIN_BACKOFF
+			return parsePluginDocument(line)
+		case <-deadline.C:
+			// The plugin is stuck or out of sync, start from scratch
+			p.kill()
+			return nil, p.crashed(fmt.Errorf("no response within %s", p.timeout))
+		case <-ctx.Done():
+			// The late response is skipped by the next collection
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Stop closes the standard input of the plugin, asking it to exit, and kills it
+// if it is still running after a grace period.
+func (p *PersistentPlugin) Stop() {
+	if p.process == nil {
+		return
+	}
+	p.process.stopReceiving()
+	p.process.stdin.Close()
+	select {
+	case <-p.process.exited:
+	case <-time.After(PLUGIN_STOP_GRACE):
+		p.kill()
+	}
+	p.process = nil
+}
+
+// start launches the plugin process and the goroutines reading its outputs.
+func (p *PersistentPlugin) start() error {
+	cmd := exec.Command("bash", "-c", p.command)
+	prepareProcessGroup(cmd)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start plugin: %w", err)
+	}
+
+	process := &pluginProcess{
+		cmd:     cmd,
+		stdin:   stdin,
+		lines:   make(chan []byte),
+		discard: make(chan struct{}),
+		exited:  make(chan struct{}),
+	}
+
+	// The process is waited for once its outputs are read, as Wait closes them
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go func() {
+		defer readers.Done()
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			p.stderrMu.Lock()
+			p.stderr = append(p.stderr, scanner.Text())
+			if len(p.stderr) > PLUGIN_STDERR_LINES {
+				p.stderr = p.stderr[1:]
+			}
+			p.stderrMu.Unlock()
+		}
+	}()
+	go func() {
+		defer readers.Done()
+		defer close(process.lines)
+		reader := bufio.NewReader(stdout)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if len(strings.TrimSpace(string(line))) > 0 {
+				select {
+				case process.lines <- line:
+				case <-process.discard:
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		readers.Wait()
+		process.err = cmd.Wait()
+		close(process.exited)
+	}()
+
+	p.process = process
+	return nil
+}
+
+// kill terminates the plugin process along with the commands it started, and waits
+// for it to exit.
+func (p *PersistentPlugin) kill() {
+	if p.process == nil {
+		return
+	}
+	p.process.stopReceiving()
+	killProcessGroup(p.process.cmd)
+	<-p.process.exited
+}
+
+// crashed forgets the plugin process, schedules its restart and returns the
+// reason of the crash along with the last lines of its error output.
+func (p *PersistentPlugin) crashed(reason error) error {
+	p.kill()
+	p.process = nil
+	p.scheduleRestart()
+
+	p.stderrMu.Lock()
+	stderr := strings.Join(p.stderr, "\n")
+	p.stderr = nil
+	p.stderrMu.Unlock()
+	if stderr != "" {
+		return fmt.Errorf("plugin stopped: %v: %s", reason, stderr)
+	}
+	return fmt.Errorf("plugin stopped: %v", reason)
+}
+
+// scheduleRestart delays the next start of the plugin by the current backoff,
+// and doubles the backoff for the next crash.
+func (p *PersistentPlugin) scheduleRestart() {
+	p.nextStart = time.Now().Add(p.backoff)
+	p.backoff = min(p.backoff*2, PLUGIN_MAX_BACKOFF)
+}
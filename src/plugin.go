@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DEFAULT_PLUGIN_TIMEOUT is the time a plugin is given to print its document
+// when its configuration does not set one.
+const DEFAULT_PLUGIN_TIMEOUT = 10 * time.Second
+
+// pluginDocument represents the JSON document printed by a plugin.
+//
+// Fields:
+// - Entities: The entities of the plugin and their values.
+type pluginDocument struct {
+	Entities []CollectedEntity `json:"entities"`
+}
+
+// parsePluginDocument decodes and validates the JSON document printed by a plugin.
+func parsePluginDocument(data []byte) ([]CollectedEntity, error) {
+	var document pluginDocument
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil {
+		return nil, fmt.Errorf("invalid plugin document: %w", err)
+	}
+	for i, entity := range document.Entities {
+		if strings.TrimSpace(entity.Name) == "" {
+			return nil, fmt.Errorf("invalid plugin document: entity %d has no name", i+1)
+		}
+		// Numbers are decoded as json.Number to keep integers exact, and
+		// converted to float64 like any other value of the agent
+		if number, ok := entity.Value.(json.Number); ok {
+			value, err := number.Float64()
+			if err != nil {
+				return nil, fmt.Errorf("invalid plugin document: entity %q: %w", entity.Name, err)
+			}
+			document.Entities[i].Value = value
+		}
+	}
+	return document.Entities, nil
+}
+
+// ExecPlugin is a Collector running an executable once per cycle and reading the
+// entities it prints on its standard output as a JSON document.
+//
+// Fields:
+// - name: The name of the plugin.
+// - command: The command starting the plugin.
+// - timeout: The time the plugin is given to print its document.
+type ExecPlugin struct {
+	name    string
+	command string
+	timeout time.Duration
+}
+
+// NewExecPlugin creates a new plugin from its configuration file entry.
+//
+// Parameters:
+//   - cfg: The plugin entry of the configuration file.
+//
+// Returns:
+//   - A pointer to the newly created ExecPlugin instance.
+//   - An error if the configuration is invalid.
+func NewExecPlugin(cfg PluginConfig) (*ExecPlugin, error) {
+	if cfg.Name == "" || cfg.Command == "" {
+		return nil, fmt.Errorf("plugins need a name and a command")
+	}
+	if cfg.TimeoutS < 0 {
+		return nil, fmt.Errorf("plugin %q: timeout must not be negative", cfg.Name)
+	}
+	timeout := DEFAULT_PLUGIN_TIMEOUT
+	if cfg.TimeoutS > 0 {
+		timeout = time.Duration(cfg.TimeoutS) * time.Second
+	}
+	return &ExecPlugin{
+		name:    cfg.Name,
+		command: cfg.Command,
+		timeout: timeout,
+	}, nil
+}
+
+// Name returns the name of the plugin.
+func (p *ExecPlugin) Name() string {
+	return p.name
+}
+
+// Collect runs the plugin and returns the entities of its document.
+// The plugin is killed if it does not exit before its timeout.
+func (p *ExecPlugin) Collect(ctx context.Context) ([]CollectedEntity, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	cmd := shellCommand(ctx, p.command)
+	// Do not wait forever for children of the plugin keeping its output open
+	cmd.WaitDelay = time.Second
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("timed out after %s", p.timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return parsePluginDocument(output)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CLOCK_TICKS_PER_SECOND is the unit of the CPU times reported by the kernel
+// (USER_HZ), which is 100 on every Linux architecture.
+const CLOCK_TICKS_PER_SECOND = 100
+
+// procInfo represents the state of a process read from the operating system.
+//
+// Fields:
+// - pid: The identifier of the process.
+// - ppid: The identifier of its parent.
+// - name: The name of its executable, as shown by ps.
+// - cmdline: Its command line, arguments separated by spaces.
+// - cgroup: The path of its control group.
+// - cpuTicks: The CPU time it consumed, user and system, in clock ticks.
+// - rss: Its resident memory in bytes.
+// - threads: Its number of threads.
+// - fds: Its number of open file descriptors, or -1 when they cannot be listed.
+// - started: The time it started.
+type procInfo struct {
+	pid      int
+	ppid     int
+	name     string
+	cmdline  string
+	cgroup   string
+	cpuTicks uint64
+	rss      uint64
+	threads  int
+	fds      int
+	started  time.Time
+}
+
+// processMatcher selects the processes of a group among the processes of the system.
+type processMatcher func(processes []procInfo) ([]procInfo, error)
+
+// ProcessMonitor is a Collector publishing whether a group of processes is running
+// and how much it consumes: number of processes, CPU usage, resident memory, open
+// file descriptors, threads and uptime of the oldest process.
+//
+// Fields:
+// - name: The name of the group, prefixing the names of its entities.
+// - match: Selects the processes of the group.
+// - lastTicks: The CPU time of every process of the group at the previous collection.
+// - lastCollect: The time of the previous collection, for the CPU usage.
+type ProcessMonitor struct {
+	name  string
+	match processMatcher
+
+	lastTicks   map[int]uint64
+	lastCollect time.Time
+}
+
+// NewProcessMonitor creates a new process monitor from its configuration file entry.
+//
+// Parameters:
+//   - cfg: The process entry of the configuration file.
+//
+// Returns:
+//   - A pointer to the newly created ProcessMonitor instance.
+//   - An error if the configuration is invalid.
+func NewProcessMonitor(cfg ProcessConfig) (*ProcessMonitor, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("processes need a name")
+	}
+	monitor := &ProcessMonitor{name: cfg.Name}
+
+	set := 0
+	for _, value := range []string{cfg.ProcessName, cfg.Cmdline, cfg.Pidfile, cfg.SystemdUnit} {
+		if value != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, fmt.Errorf("process %q: exactly one of process_name, cmdline, pidfile and systemd_unit must be set", cfg.Name)
+	}
+
+	switch {
+	case cfg.ProcessName != "":
+		monitor.match = matchProcessName(cfg.ProcessName)
+	case cfg.Cmdline != "":
+		regex, err := regexp.Compile(cfg.Cmdline)
+		if err != nil {
+			return nil, fmt.Errorf("process %q: %w", cfg.Name, err)
+		}
+		monitor.match = matchCmdline(regex)
+	case cfg.Pidfile != "":
+		monitor.match = matchPidfile(cfg.Pidfile)
+	case cfg.SystemdUnit != "":
+		monitor.match = matchSystemdUnit(cfg.SystemdUnit)
+	}
+	return monitor, nil
+}
+
+// Name returns the name of the process group.
+func (m *ProcessMonitor) Name() string {
+	return m.name
+}
+
+// Collect lists the processes of the group and returns the entities describing them.
+// The CPU usage is the share of a single core used since the previous collection,
+// it is unknown at the first collection.
+func (m *ProcessMonitor) Collect(ctx context.Context) ([]CollectedEntity, error) {
+	now := time.Now()
+	processes, err := listProcesses()
+	if err != nil {
+		return nil, err
+	}
+	matched, err := m.match(processes)
+	if err != nil {
+		return nil, err
+	}
+
+	var rss, threads, fds, deltaTicks uint64
+	fdsKnown := true
+	var oldest time.Time
+	ticks := map[int]uint64{}
+	for _, process := range matched {
+		rss += process.rss
+		threads += uint64(process.threads)
+		if process.fds < 0 {
+			fdsKnown = false
+		} else {
+			fds += uint64(process.fds)
+		}
+		if oldest.IsZero() || process.started.Before(oldest) {
+			oldest = process.started
+		}
+		// Processes started since the previous collection count from their next collection
+		ticks[process.pid] = process.cpuTicks
+		if previous, ok := m.lastTicks[process.pid]; ok && process.cpuTicks >= previous {
+			deltaTicks += process.cpuTicks - previous
+		}
+	}
+
+	var cpu, uptime, openFiles any
+	if m.lastTicks != nil {
+		cpu = float64(deltaTicks) / CLOCK_TICKS_PER_SECOND / now.Sub(m.lastCollect).Seconds() * 100
+	}
+	if len(matched) > 0 {
+		uptime = now.Sub(oldest).Seconds()
+	}
+	if fdsKnown {
+		openFiles = float64(fds)
+	}
+	m.lastTicks = ticks
+	m.lastCollect = now
+
+	return []CollectedEntity{
+		{Name: m.name + " Running", Platform: PLATFORM_BINARY_SENSOR, DeviceClass: "running", Value: len(matched) > 0},
+		{Name: m.name + " Processes", StateClass: "measurement", Icon: "mdi:application-cog", Value: float64(len(matched))},
+		{Name: m.name + " CPU", StateClass: "measurement", Unit: "%", Icon: "mdi:cpu-64-bit", Value: cpu},
+		{Name: m.name + " Memory", DeviceClass: "data_size", StateClass: "measurement", Unit: "MiB", Value: float64(rss) / (1 << 20)},
+		{Name: m.name + " Open Files", StateClass: "measurement", Icon: "mdi:file-multiple", Value: openFiles},
+		{Name: m.name + " Threads", StateClass: "measurement", Icon: "mdi:format-list-numbered", Value: float64(threads)},
+		{Name: m.name + " Uptime", DeviceClass: "duration", Unit: "s", Value: uptime},
+	}, nil
+}
+
+// matchProcessName selects the processes whose executable has the given name. The
+// name known by the kernel is truncated, the first argument of the command line
+// is compared too.
+func matchProcessName(name string) processMatcher {
+	return func(processes []procInfo) ([]procInfo, error) {
+		var matched []procInfo
+		for _, process := range processes {
+			argv0, _, _ := strings.Cut(process.cmdline, " ")
+			if process.name == name || filepath.Base(argv0) == name {
+				matched = append(matched, process)
+			}
+		}
+		return matched, nil
+	}
+}
+
+// matchCmdline selects the processes whose command line matches the regular
+// expression, except the agent itself.
+func matchCmdline(regex *regexp.Regexp) processMatcher {
+	return func(processes []procInfo) ([]procInfo, error) {
+		var matched []procInfo
+		for _, process := range processes {
+			if process.pid != os.Getpid() && process.cmdline != "" && regex.MatchString(process.cmdline) {
+				matched = append(matched, process)
+			}
+		}
+		return matched, nil
+	}
+}
+
+// matchPidfile selects the process whose PID is written in the file, and its
+// children. A missing file means that the process is not running.
+func matchPidfile(path string) processMatcher {
+	return func(processes []procInfo) ([]procInfo, error) {
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid pidfile %q: %w", path, err)
+		}
+
+		group := map[int]bool{pid: true}
+		// Children may be listed before their parent, repeat until the group is complete
+		for grown := true; grown; {
+			grown = false
+			for _, process := range processes {
+				if !group[process.pid] && group[process.ppid] {
+					group[process.pid] = true
+					grown = true
+				}
+			}
+		}
+		var matched []procInfo
+		for _, process := range processes {
+			if group[process.pid] {
+				matched = append(matched, process)
+			}
+		}
+		return matched, nil
+	}
+}
+
+// matchSystemdUnit selects the processes of the control group of a systemd unit.
+func matchSystemdUnit(unit string) processMatcher {
+	if !strings.Contains(unit, ".") {
+		unit += ".service"
+	}
+	return func(processes []procInfo) ([]procInfo, error) {
+		var matched []procInfo
+		for _, process := range processes {
+			if slices.Contains(strings.Split(process.cgroup, "/"), unit) {
+				matched = append(matched, process)
+			}
+		}
+		return matched, nil
+	}
+}
@@ -0,0 +1,152 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PROC_ROOT is the mount point of the process information pseudo-filesystem.
+const PROC_ROOT = "/proc"
+
+// listProcesses reads the state of every process of the system from /proc.
+// Processes exiting while they are read are skipped.
+func listProcesses() ([]procInfo, error) {
+	entries, err := os.ReadDir(PROC_ROOT)
+	if err != nil {
+		return nil, err
+	}
+	bootTime, err := readBootTime()
+	if err != nil {
+		return nil, err
+	}
+
+	var processes []procInfo
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		process, err := readProcess(pid, bootTime)
+		if err != nil {
+			continue
+		}
+		processes = append(processes, process)
+	}
+	return processes, nil
+}
+
+// readProcess reads the state of a single process.
+func readProcess(pid int, bootTime time.Time) (procInfo, error) {
+	dir := filepath.Join(PROC_ROOT, strconv.Itoa(pid))
+	stat, err := os.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return procInfo{}, err
+	}
+	process, err := parseProcStat(string(stat), bootTime)
+	if err != nil {
+		return procInfo{}, err
+	}
+
+	// Kernel threads have no command line
+	if cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline")); err == nil {
+		process.cmdline = strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+	}
+	if cgroup, err := os.ReadFile(filepath.Join(dir, "cgroup")); err == nil {
+		process.cgroup = parseProcCgroup(string(cgroup))
+	}
+	// The descriptors of the processes of other users can only be listed by root
+	process.fds = -1
+	if fds, err := os.ReadDir(filepath.Join(dir, "fd")); err == nil {
+		process.fds = len(fds)
+	}
+	return process, nil
+}
+
+// parseProcStat parses the content of /proc/<pid>/stat. The name of the process is
+// enclosed in parentheses and may itself contain spaces and parentheses, the other
+// fields follow the last closing parenthesis.
+func parseProcStat(stat string, bootTime time.Time) (procInfo, error) {
+	open := strings.IndexByte(stat, '(')
+	closing := strings.LastIndexByte(stat, ')')
+	if open < 0 || closing < open {
+		return procInfo{}, fmt.Errorf("invalid stat line %q", stat)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(stat[:open]))
+	if err != nil {
+		return procInfo{}, fmt.Errorf("invalid stat line %q", stat)
+	}
+	// fields[0] is the 3rd field of proc(5), the state of the process
+	fields := strings.Fields(stat[closing+1:])
+	if len(fields) < 22 {
+		return procInfo{}, fmt.Errorf("invalid stat line %q", stat)
+	}
+
+	numbers := map[int]uint64{}
+	for _, field := range []int{4, 14, 15, 20, 22, 24} {
+		value, err := strconv.ParseUint(fields[field-3], 10, 64)
+		if err != nil {
+			return procInfo{}, fmt.Errorf("invalid stat field %d %q", field, fields[field-3])
+		}
+		numbers[field] = value
+	}
+	return procInfo{
+		pid:      pid,
+		ppid:     int(numbers[4]),
+		name:     stat[open+1 : closing],
+		cpuTicks: numbers[14] + numbers[15],
+		threads:  int(numbers[20]),
+		started:  bootTime.Add(time.Duration(numbers[22]) * time.Second / CLOCK_TICKS_PER_SECOND),
+		rss:      numbers[24] * uint64(os.Getpagesize()),
+	}, nil
+}
+
+// parseProcCgroup returns the control group of a process from the content of
+// /proc/<pid>/cgroup, preferring the unified hierarchy, then the systemd one.
+func parseProcCgroup(content string) string {
+	var systemd string
+	for _, line := range strings.Split(content, "\n") {
+		// Lines are hierarchy-ID:controllers:path
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[0] == "0" && parts[1] == "" {
+			return parts[2]
+		}
+		if parts[1] == "name=systemd" {
+			systemd = parts[2]
+		}
+	}
+	return systemd
+}
+
+// readBootTime returns the time the system booted, from the btime line of /proc/stat.
+func readBootTime() (time.Time, error) {
+	file, err := os.Open(filepath.Join(PROC_ROOT, "stat"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if value, found := strings.CutPrefix(scanner.Text(), "btime "); found {
+			seconds, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("invalid boot time %q", value)
+			}
+			return time.Unix(seconds, 0), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return time.Time{}, err
+	}
+	return time.Time{}, fmt.Errorf("boot time not found in /proc/stat")
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+// listProcesses is not available outside Linux, whose /proc describes the processes.
+func listProcesses() ([]procInfo, error) {
+	return nil, fmt.Errorf("process monitoring is only supported on Linux")
+}
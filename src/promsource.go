@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DEFAULT_SCRAPE_TIMEOUT is the time a Prometheus endpoint is given to answer when
+// its configuration does not set one.
+const DEFAULT_SCRAPE_TIMEOUT = 10 * time.Second
+
+// promSeries represents a sample of the exposition format. The name of the metric
+// is also held by the __name__ label, for the selectors.
+type promSeries struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+// labelMatcher represents a label matcher of a selector: name="value", name!="value",
+// name=~"regex" or name!~"regex". A missing label matches the empty value.
+type labelMatcher struct {
+	name  string
+	op    string
+	value string
+	regex *regexp.Regexp
+}
+
+// promMetric represents a compiled metric mapping of a Prometheus source.
+type promMetric struct {
+	config    PrometheusMetricConfig
+	name      *template.Template
+	selector  []labelMatcher
+	transform *Transform
+}
+
+// PrometheusSource is a Collector reading metrics in the Prometheus exposition
+// format from an HTTP endpoint or a file, and publishing the selected series as
+// entities, one per series. Entities follow the series as they come and go.
+//
+// Fields:
+// - name: The name of the source.
+// - url: The URL of the endpoint, unless a file is read.
+// - file: The file to read, unless an endpoint is scraped.
+// - timeout: The time the endpoint is given to answer.
+// - metrics: The mappings of the series to entities.
+type PrometheusSource struct {
+	name    string
+	url     string
+	file    string
+	timeout time.Duration
+	metrics []promMetric
+}
+
+// NewPrometheusSource creates a new Prometheus source from its configuration file entry.
+//
+// Parameters:
+//   - cfg: The Prometheus source entry of the configuration file.
+//
+// Returns:
+//   - A pointer to the newly created PrometheusSource instance.
+//   - An error if the configuration is invalid.
+func NewPrometheusSource(cfg PrometheusSourceConfig) (*PrometheusSource, error) {
+	if (cfg.URL == "") == (cfg.File == "") {
+		return nil, fmt.Errorf("prometheus source %q: exactly one of url and file must be set", cfg.Name)
+	}
+	if cfg.TimeoutS < 0 {
+		return nil, fmt.Errorf("prometheus source %q: timeout must not be negative", cfg.Name)
+	}
+	source := &PrometheusSource{
+		name:    cfg.Name,
+		url:     cfg.URL,
+		file:    cfg.File,
+		timeout: DEFAULT_SCRAPE_TIMEOUT,
+	}
+	if source.name == "" {
+		source.name = cfg.URL + cfg.File
+	}
+	if cfg.TimeoutS > 0 {
+		source.timeout = time.Duration(cfg.TimeoutS) * time.Second
+	}
+	if len(cfg.Metrics) == 0 {
+		return nil, fmt.Errorf("prometheus source %q: no metrics", source.name)
+	}
+
+	for _, metricConfig := range cfg.Metrics {
+		if metricConfig.Name == "" {
+			return nil, fmt.Errorf("prometheus source %q: metric %q has no name", source.name, metricConfig.Metric)
+		}
+		name, err := template.New("name").Option("missingkey=error").Parse(metricConfig.Name)
+		if err != nil {
+			return nil, fmt.Errorf("prometheus source %q: %w", source.name, err)
+		}
+		selector, err := parseSelector(metricConfig.Metric)
+		if err != nil {
+			return nil, fmt.Errorf("prometheus source %q: metric %q: %w", source.name, metricConfig.Name, err)
+		}
+		transform, err := NewTransform(metricConfig.Transform)
+		if err != nil {
+			return nil, fmt.Errorf("prometheus source %q: metric %q: %w", source.name, metricConfig.Name, err)
+		}
+		source.metrics = append(source.metrics, promMetric{
+			config:    metricConfig,
+			name:      name,
+			selector:  selector,
+			transform: transform,
+		})
+	}
+	return source, nil
+}
+
+// Name returns the name of the source.
+func (p *PrometheusSource) Name() string {
+	return p.name
+}
+
+// Collect reads the metrics and returns an entity for every selected series, with
+// the labels of the series as attributes.
+func (p *PrometheusSource) Collect(ctx context.Context) ([]CollectedEntity, error) {
+	data, err := p.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	series, err := parseExposition(string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var entities []CollectedEntity
+	keys := map[string]bool{}
+	for _, metric := range p.metrics {
+		for _, sample := range series {
+			if !matchesSelector(metric.selector, sample.labels) {
+				continue
+			}
+			var name bytes.Buffer
+			if err := metric.name.Execute(&name, sample.labels); err != nil {
+				return nil, fmt.Errorf("metric %q: %w", metric.config.Name, err)
+			}
+			// Labels are often paths, the entities are told apart by their sanitized keys
+			key := sensorKey(name.String())
+			if keys[key] {
+				return nil, fmt.Errorf("metric %q: several series have the key %q, the name must depend on their labels", metric.config.Name, key)
+			}
+			keys[key] = true
+
+			attributes := map[string]any{}
+			for label, value := range sample.labels {
+				if label != "__name__" {
+					attributes[label] = value
+				}
+			}
+			entity := CollectedEntity{
+				Name:        name.String(),
+				Unit:        metric.config.UnitOfMeasurement,
+				DeviceClass: metric.config.DeviceClass,
+				StateClass:  metric.config.StateClass,
+				Icon:        metric.config.Icon,
+				Attributes:  attributes,
+			}
+			// NaN and infinities cannot be published
+			if !math.IsNaN(sample.value) && !math.IsInf(sample.value, 0) {
+				value, err := metric.transform.Apply(strconv.FormatFloat(sample.value, 'f', -1, 64))
+				if err != nil {
+					return nil, fmt.Errorf("metric %q: %w", name.String(), err)
+				}
+				entity.Value = value
+			}
+			entities = append(entities, entity)
+		}
+	}
+	return entities, nil
+}
+
+// read returns the content of the file, or scrapes the endpoint.
+func (p *PrometheusSource) read(ctx context.Context) ([]byte, error) {
+	if p.file != "" {
+		return os.ReadFile(p.file)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/plain;version=0.0.4")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("scrape of %s failed: %s", p.url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// parseExposition parses the samples of a document in the Prometheus text
+// exposition format. Comments, such as HELP and TYPE lines, are ignored.
+func parseExposition(data string) ([]promSeries, error) {
+	var series []promSeries
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sample, err := parseSample(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exposition line %d: %w", i+1, err)
+		}
+		series = append(series, sample)
+	}
+	return series, nil
+}
+
+// parseSample parses a sample line: a metric name, optional labels, a value and
+// an optional timestamp, which is ignored.
+func parseSample(line string) (promSeries, error) {
+	end := strings.IndexAny(line, "{ \t")
+	if end <= 0 {
+		return promSeries{}, fmt.Errorf("%q has no value", line)
+	}
+	sample := promSeries{name: line[:end], labels: map[string]string{"__name__": line[:end]}}
+	rest := line[end:]
+	if strings.HasPrefix(rest, "{") {
+		labels, length, err := parseLabels(rest, false)
+		if err != nil {
+			return promSeries{}, err
+		}
+		for _, label := range labels {
+			sample.labels[label.name] = label.value
+		}
+		rest = rest[length:]
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) != 1 && len(fields) != 2 {
+		return promSeries{}, fmt.Errorf("%q has no value", line)
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return promSeries{}, fmt.Errorf("invalid value %q", fields[0])
+	}
+	sample.value = value
+	return sample, nil
+}
+
+// parseSelector parses a series selector: a metric name followed by optional label
+// matchers between braces, or label matchers only.
+func parseSelector(selector string) ([]labelMatcher, error) {
+	selector = strings.TrimSpace(selector)
+	name, rest, _ := strings.Cut(selector, "{")
+	name = strings.TrimSpace(name)
+
+	var matchers []labelMatcher
+	if name != "" {
+		matchers = append(matchers, labelMatcher{name: "__name__", op: "=", value: name})
+	}
+	if strings.Contains(selector, "{") {
+		labels, length, err := parseLabels("{"+rest, true)
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(rest[length-1:]) != "" {
+			return nil, fmt.Errorf("unexpected %q after the label matchers", rest[length-1:])
+		}
+		matchers = append(matchers, labels...)
+	}
+	if len(matchers) == 0 {
+		return nil, fmt.Errorf("empty selector")
+	}
+	return matchers, nil
+}
+
+// parseLabels parses a list of labels between braces at the start of the text, and
+// returns them with the length of the list. Selectors accept every matcher
+// operator, samples only accept `=`.
+func parseLabels(text string, selector bool) ([]labelMatcher, int, error) {
+	var labels []labelMatcher
+	i := 1
+	for {
+		for i < len(text) && (text[i] == ' ' || text[i] == ',') {
+			i++
+		}
+		if i >= len(text) {
+			return nil, 0, fmt.Errorf("unterminated labels in %q", text)
+		}
+		if text[i] == '}' {
+			return labels, i + 1, nil
+		}
+
+		start := i
+		for i < len(text) && (text[i] == '_' || text[i] >= 'a' && text[i] <= 'z' || text[i] >= 'A' && text[i] <= 'Z' || text[i] >= '0' && text[i] <= '9') {
+			i++
+		}
+		label := labelMatcher{name: text[start:i]}
+		if label.name == "" {
+			return nil, 0, fmt.Errorf("invalid label name in %q", text)
+		}
+		for i < len(text) && text[i] == ' ' {
+			i++
+		}
+		for _, op := range []string{"=~", "!~", "!=", "="} {
+			if strings.HasPrefix(text[i:], op) && (selector || op == "=") {
+				label.op = op
+				i += len(op)
+				break
+			}
+		}
+		if label.op == "" {
+			return nil, 0, fmt.Errorf("invalid operator after label %q", label.name)
+		}
+		for i < len(text) && text[i] == ' ' {
+			i++
+		}
+
+		if i >= len(text) || text[i] != '"' {
+			return nil, 0, fmt.Errorf("label %q has no quoted value", label.name)
+		}
+		var value strings.Builder
+		for i++; i < len(text) && text[i] != '"'; i++ {
+			if text[i] == '\\' && i+1 < len(text) {
+				i++
+				switch text[i] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(text[i])
+				}
+				continue
+			}
+			value.WriteByte(text[i])
+		}
+		if i >= len(text) {
+			return nil, 0, fmt.Errorf("unterminated value of label %q", label.name)
+		}
+		i++
+		label.value = value.String()
+
+		if label.op == "=~" || label.op == "!~" {
+			regex, err := regexp.Compile("^(?:" + label.value + ")$")
+			if err != nil {
+				return nil, 0, fmt.Errorf("label %q: %w", label.name, err)
+			}
+			label.regex = regex
+		}
+		labels = append(labels, label)
+	}
+}
+
+// matchesSelector reports whether the labels of a series satisfy every matcher.
+func matchesSelector(matchers []labelMatcher, labels map[string]string) bool {
+	for _, matcher := range matchers {
+		value := labels[matcher.name]
+		var matched bool
+		switch matcher.op {
+		case "=":
+			matched = value == matcher.value
+		case "!=":
+			matched = value != matcher.value
+		case "=~":
+			matched = matcher.regex.MatchString(value)
+		case "!~":
+			matched = !matcher.regex.MatchString(value)
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestPrometheusSource returns a source reading the given exposition from a file.
+func newTestPrometheusSource(t *testing.T, exposition string, metric PrometheusMetricConfig) *PrometheusSource {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "metrics.prom")
+	if err := os.WriteFile(file, []byte(exposition), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	source, err := NewPrometheusSource(PrometheusSourceConfig{File: file, Metrics: []PrometheusMetricConfig{metric}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return source
+}
+
+func TestPrometheusSourceMountPointKeys(t *testing.T) {
+	source := newTestPrometheusSource(t, `# TYPE node_filesystem_avail_bytes gauge
+node_filesystem_avail_bytes{device="/dev/sda1",fstype="ext4",mountpoint="/"} 4.2e+10
+node_filesystem_avail_bytes{device="/dev/sda2",fstype="ext4",mountpoint="/home"} 1.1e+11
+node_filesystem_avail_bytes{device="tmpfs",fstype="tmpfs",mountpoint="/run"} 1.6e+09
+`, PrometheusMetricConfig{
+		Name:   "Free Space {{.mountpoint}}",
+		Metric: `node_filesystem_avail_bytes{fstype!~"tmpfs|overlay"}`,
+	})
+
+	device := NewDevice("Host", "Manufacturer", "Model", "host-sn")
+	device.AddCollector(source)
+	components := collectedComponents(t, device)
+	for key, name := range map[string]string{
+		"free_space":      "Free Space /",
+		"free_space_home": "Free Space /home",
+	} {
+		sensor := device.GetSensorByName(name)
+		if sensor == nil {
+			t.Fatalf("no sensor named %q", name)
+		}
+		if sensor.Key() != key {
+			t.Errorf("key of %q = %q, want %q", name, sensor.Key(), key)
+		}
+		if component, ok := components[key]; !ok || component.ValueTemplate != "{{ value_json."+key+" }}" {
+			t.Errorf("component %q = %+v (found %v)", key, component, ok)
+		}
+	}
+	if device.GetSensorByName("Free Space /run") != nil {
+		t.Error("the tmpfs series is not left out")
+	}
+}
+
+func TestPrometheusSourceSeriesSharingKey(t *testing.T) {
+	source := newTestPrometheusSource(t, `queue_length{queue="a-b"} 1
+queue_length{queue="a_b"} 2
+`, PrometheusMetricConfig{Name: "Queue {{.queue}}", Metric: "queue_length"})
+	if _, err := source.Collect(context.Background()); err == nil || !strings.Contains(err.Error(), `"queue_a_b"`) {
+		t.Errorf("Collect() = %v, want an error about the key queue_a_b", err)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AGGREGATE_MEAN   = "mean"
+	AGGREGATE_MIN    = "min"
+	AGGREGATE_MAX    = "max"
+	AGGREGATE_MEDIAN = "median"
+	AGGREGATE_SUM    = "sum"
+	AGGREGATE_COUNT  = "count"
+	AGGREGATE_LAST   = "last"
+)
+
+// sampler measures a sensor at a high rate in the background and keeps the
+// samples of the current publish window. Several sensors can share the same
+// sampler, each of them publishing a different aggregate of the window.
+//
+// Fields:
+// - measure: The function returning a new sample.
+// - period: The interval between two samples.
+// - samples: The samples of the window being filled.
+// - window: The sorted samples of the last complete window.
+// - lastSample: The last sample of the last complete window.
+// - err: The last error raised while filling the current window.
+// - windowErr: The last error raised while filling the last complete window.
+type sampler struct {
+	measure func(ctx context.Context) (string, error)
+	period  time.Duration
+
+	mu         sync.Mutex
+	samples    []float64
+	window     []float64
+	lastSample float64
+	err        error
+	windowErr  error
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// newSampler creates a sampler calling measure every period.
+// The sampler does nothing until it is started.
+func newSampler(measure func(ctx context.Context) (string, error), period time.Duration) *sampler {
+	return &sampler{
+		measure: measure,
+		period:  period,
+	}
+}
+
+// start launches the background sampling loop.
+func (s *sampler) start() {
+	if s.cancel != nil {
+		return
+	}
+	// Halting the sampler also stops the measurement in progress
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(s.period)
+		defer ticker.Stop()
+		for {
+			s.sample(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// halt stops the background sampling loop and waits for it to exit.
+func (s *sampler) halt() {
+	if s.cancel == nil {
+		return
+	}
+	s.cancel()
+	<-s.done
+	s.cancel = nil
+}
+
+// sample takes a single sample and adds it to the current window.
+func (s *sampler) sample(ctx context.Context) {
+	value, err := s.measure(ctx)
+	if err == nil {
+		var floatValue float64
+		floatValue, err = strconv.ParseFloat(value, 64)
+		if err == nil {
+			s.mu.Lock()
+			s.samples = append(s.samples, floatValue)
+			s.mu.Unlock()
+			return
+		}
+		err = fmt.Errorf("value %q is not numeric: %w", value, err)
+	}
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+// roll closes the current window and starts a new one. The closed window is
+// kept until the next roll so that every sensor sharing the sampler reads the
+// same samples.
+func (s *sampler) roll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.samples) > 0 {
+		s.lastSample = s.samples[len(s.samples)-1]
+	}
+	s.window = s.samples
+	slices.Sort(s.window)
+	s.windowErr = s.err
+	s.samples = nil
+	s.err = nil
+}
+
+// aggregate computes the given aggregate over the last complete window.
+// It returns the last sampling error of the window (or ErrNoValue) if the window
+// is empty.
+func (s *sampler) aggregate(kind string) (float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.window) == 0 {
+		if kind == AGGREGATE_COUNT {
+			return 0, nil
+		}
+		if s.windowErr != nil {
+			return 0, s.windowErr
+		}
+		return 0, ErrNoValue
+	}
+
+	switch kind {
+	case AGGREGATE_MEAN:
+		return sum(s.window) / float64(len(s.window)), nil
+	case AGGREGATE_MIN:
+		return s.window[0], nil
+	case AGGREGATE_MAX:
+		return s.window[len(s.window)-1], nil
+	case AGGREGATE_MEDIAN:
+		return percentile(s.window, 50), nil
+	case AGGREGATE_SUM:
+		return sum(s.window), nil
+	case AGGREGATE_COUNT:
+		return float64(len(s.window)), nil
+	case AGGREGATE_LAST:
+		return s.lastSample, nil
+	}
+
+	p, err := parsePercentile(kind)
+	if err != nil {
+		return 0, err
+	}
+	return percentile(s.window, p), nil
+}
+
+// validateAggregate returns an error if kind is not a known aggregate.
+// Besides the named aggregates, percentiles are written "p" followed by a
+// number between 0 and 100 (e.g. "p95").
+func validateAggregate(kind string) error {
+	switch kind {
+	case AGGREGATE_MEAN, AGGREGATE_MIN, AGGREGATE_MAX, AGGREGATE_MEDIAN,
+		AGGREGATE_SUM, AGGREGATE_COUNT, AGGREGATE_LAST:
+		return nil
+	}
+	_, err := parsePercentile(kind)
+	return err
+}
+
+func parsePercentile(kind string) (float64, error) {
+	if !strings.HasPrefix(kind, "p") {
+		return 0, fmt.Errorf("unknown aggregate %q", kind)
+	}
+	p, err := strconv.ParseFloat(kind[1:], 64)
+	if err != nil || p < 0 || p > 100 {
+		return 0, fmt.Errorf("unknown aggregate %q", kind)
+	}
+	return p, nil
+}
+
+// percentile returns the p-th percentile of sorted values using linear
+// interpolation between the closest ranks.
+func percentile(sorted []float64, p float64) float64 {
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+func sum(values []float64) float64 {
+	total := 0.0
+	for _, v := range values {
+		total += v
+	}
+	return total
+}
@@ -1,8 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"os/exec"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/iancoleman/strcase"
 )
 
 // sensorConfig represents the configuration for a sensor.
@@ -15,22 +24,68 @@ import (
 // - DeviceClass: The type or category of the sensor (e.g., temperature, humidity).
 // - StateClass: The classification of the sensor's state (e.g., measurement, total).
 // - UnitOfMeasurement: The unit in which the sensor's data is measured (e.g., °C, %, m/s).
+// - Icon: The icon used to represent the sensor in Home Assistant.
+// - Transform: The post-processing pipeline applied to the command output.
+// - Precision: The number of decimals kept when publishing numeric values.
+// - ExpireAfter: The time in seconds after which Home Assistant marks the sensor unavailable.
+// - Platform: The Home Assistant platform of the sensor (sensor or binary_sensor).
+// - ValueField: The field of the JSON output holding the value, if any.
+// - Attributes: Whether the sensor publishes attributes along its value.
+// - EventTypes: The types of the events fired by an event entity.
+// - UniqueID: The unique identifier of the sensor in Home Assistant, generated from its name if empty.
+// - Discovered: Whether the sensor was generated by the autodiscovery, its key is then sanitized.
+// - Generated: Whether the name of the sensor comes from the outside, such as the entity of a collector or the item of a template, its key is then sanitized.
 type sensorConfig struct {
 	Name              string
+	Platform          string
 	Command           string
 	DeviceClass       string
 	StateClass        string
 	UnitOfMeasurement string
 	Icon              string
+	Transform         *Transform
+	Precision         int
+	ExpireAfter       int
+	ValueField        string
+	Attributes        bool
+	EventTypes        []string
+	UniqueID          string
+	Discovered        bool
+	Generated         bool
 }
 
+// invalidKeyPattern matches the runs of characters which are neither letters nor digits.
+var invalidKeyPattern = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+
 // Sensor represents a sensor device in the system.
 // It contains configuration details, the current value of the sensor,
-// and a reference to the associated Device.
+// the optional counter deriver or background sampler, the optional deadband
+// filtering its publications, and a reference to the associated Device.
+// Binary sensors compute their state with a binaryEvaluator instead.
+// Sensors with attributes keep the details of their last command run in run.
+// Sensors created for the entities of a Collector have no command, their
+// readings are produced by the collector. Stream sensors keep their command
+// running and read its lines in the background with their streamer.
+//
+// A sampled sensor publishes an aggregate of the samples taken since the previous
+// cycle. The additional aggregates exposed as their own entities are sensors
+// sharing the same sampler, listed in linked.
 type Sensor struct {
-	config *sensorConfig
-	value  string
-	Device *Device
+	config     *sensorConfig
+	value      string
+	deriver    *deriver
+	sampler    *sampler
+	aggregate  string
+	linked     []*Sensor
+	deadband   *deadband
+	binary     binaryEvaluator
+	invert     bool
+	last       Reading
+	attributes *attributesSource
+	run        commandRun
+	collector  Collector
+	stream     *streamer
+	Device     *Device
 }
 
 // NewSensor creates and returns a new Sensor instance with the specified configuration.
@@ -49,35 +104,367 @@ func NewSensor(name string, command string, deviceClass string, stateClass strin
 	return &Sensor{
 		config: &sensorConfig{
 			Name:              name,
+			Platform:          PLATFORM_SENSOR,
 			Command:           command,
 			DeviceClass:       deviceClass,
 			StateClass:        stateClass,
 			UnitOfMeasurement: unitOfMeasurement,
 			Icon:              icon,
+			Transform:         &Transform{},
+			Precision:         DEFAULT_PRECISION,
 		},
 		value:  "",
 		Device: device,
 	}
 }
 
+// NewSensorFromConfig creates a new Sensor from its configuration file entry.
+// Unlike NewSensor, it also compiles the optional transform pipeline and applies
+// the optional settings of the sensor.
+//
+// Parameters:
+//   - cfg: The sensor entry of the configuration file.
+//   - device: A pointer to the associated Device instance.
+//
+// Returns:
+//   - A pointer to the newly created Sensor instance.
+//   - An error if the optional settings are invalid.
+func NewSensorFromConfig(cfg SensorConfig, device *Device) (*Sensor, error) {
+	if cfg.Type != "" && cfg.Type != SENSOR_TYPE_COMMAND && cfg.Type != SENSOR_TYPE_STREAM {
+		return nil, fmt.Errorf("sensor %q: unsupported type %q", cfg.Name, cfg.Type)
+	}
+	sensor := NewSensor(cfg.Name, cfg.Command, cfg.DeviceClass, cfg.StateClass, cfg.UnitOfMeasurement, cfg.Icon, device)
+	sensor.config.UniqueID = cfg.UniqueID
+	sensor.config.Discovered = cfg.Discovered
+	sensor.config.Generated = cfg.Generated
+
+	transform, err := NewTransform(cfg.Transform)
+	if err != nil {
+		return nil, fmt.Errorf("sensor %q: %w", cfg.Name, err)
+	}
+	sensor.config.Transform = transform
+
+	if cfg.Precision != nil {
+		if *cfg.Precision < 0 {
+			return nil, fmt.Errorf("sensor %q: precision must not be negative", cfg.Name)
+		}
+		sensor.config.Precision = *cfg.Precision
+	}
+
+	if cfg.Derive != "" {
+		if sensor.IsEnum() {
+			return nil, fmt.Errorf("sensor %q: enum sensors cannot be derived", cfg.Name)
+		}
+		sensor.deriver, err = newDeriver(cfg.Derive, cfg.CounterMax, device.GetDeviceInfo().SerialNumber+"/"+sensor.Key())
+		if err != nil {
+			return nil, fmt.Errorf("sensor %q: %w", cfg.Name, err)
+		}
+		// A derived total only ever grows, let Home Assistant know about it
+		if cfg.Derive == DERIVE_TOTAL && cfg.StateClass == "" {
+			sensor.config.StateClass = "total_increasing"
+		}
+	}
+
+	if cfg.MaxSilenceS < 0 || cfg.ExpireAfterS < 0 {
+		return nil, fmt.Errorf("sensor %q: max_silence_s and expire_after_s must not be negative", cfg.Name)
+	}
+	if cfg.MinChange != nil || cfg.MaxSilenceS > 0 {
+		minChange := ChangeThreshold{}
+		if cfg.MinChange != nil {
+			minChange = *cfg.MinChange
+		}
+		sensor.deadband = newDeadband(minChange, time.Duration(cfg.MaxSilenceS)*time.Second)
+	}
+	sensor.config.ExpireAfter = cfg.ExpireAfterS
+	if sensor.config.ExpireAfter == 0 && cfg.MaxSilenceS > 0 {
+		// Leave room for one missed heartbeat before marking the sensor unavailable
+		sensor.config.ExpireAfter = 2 * cfg.MaxSilenceS
+	}
+
+	sensor.config.ValueField = cfg.ValueField
+	if cfg.Attributes != nil || cfg.ValueField != "" {
+		attributesConfig := AttributesConfig{}
+		if cfg.Attributes != nil {
+			attributesConfig = *cfg.Attributes
+		}
+		sensor.attributes, err = newAttributesSource(attributesConfig, cfg.ValueField)
+		if err != nil {
+			return nil, fmt.Errorf("sensor %q: %w", cfg.Name, err)
+		}
+		sensor.config.Attributes = true
+	}
+
+	if cfg.Type == SENSOR_TYPE_STREAM {
+		if cfg.Sampling != nil || sensor.attributes != nil {
+			return nil, fmt.Errorf("sensor %q: stream sensors cannot be sampled or have attributes", cfg.Name)
+		}
+		sensor.stream = newStreamer(cfg.Command, sensor.processLine, device.notifyUpdate)
+	}
+
+	// Sampling last, the exposed aggregates copy the settings of the sensor
+	if cfg.Sampling != nil {
+		if err := sensor.setupSampling(*cfg.Sampling); err != nil {
+			return nil, fmt.Errorf("sensor %q: %w", cfg.Name, err)
+		}
+	}
+
+	return sensor, nil
+}
+
+// setupSampling creates the background sampler of the sensor and the sensors
+// exposing its additional aggregates.
+func (s *Sensor) setupSampling(cfg SamplingConfig) error {
+	if s.IsEnum() || s.deriver != nil || s.attributes != nil {
+		return fmt.Errorf("only plain numeric sensors without attributes can be sampled")
+	}
+	if cfg.PeriodS <= 0 {
+		return fmt.Errorf("sampling period must be positive")
+	}
+	if cfg.Aggregate == "" {
+		cfg.Aggregate = AGGREGATE_MEAN
+	}
+	if err := validateAggregate(cfg.Aggregate); err != nil {
+		return err
+	}
+
+	s.sampler = newSampler(s.GetSensorValue, time.Duration(cfg.PeriodS)*time.Second)
+	s.aggregate = cfg.Aggregate
+
+	for _, kind := range cfg.Expose {
+		if err := validateAggregate(kind); err != nil {
+			return err
+		}
+		config := *s.config
+		config.Name = s.config.Name + " " + strings.ToUpper(kind[:1]) + kind[1:]
+		if config.UniqueID != "" {
+			config.UniqueID += "_" + kind
+		}
+		if kind == AGGREGATE_COUNT {
+			// The number of samples does not share the unit of the samples
+			config.DeviceClass = ""
+			config.UnitOfMeasurement = ""
+		}
+		linked := &Sensor{
+			config:    &config,
+			sampler:   s.sampler,
+			aggregate: kind,
+			Device:    s.Device,
+		}
+		if s.deadband != nil {
+			linked.deadband = newDeadband(s.deadband.minChange, s.deadband.maxSilence)
+		}
+		s.linked = append(s.linked, linked)
+	}
+	return nil
+}
+
+// GetLinkedSensors returns the additional sensors sharing the sampler of this
+// sensor. They must be added to the device alongside the sensor itself.
+func (s *Sensor) GetLinkedSensors() []*Sensor {
+	return s.linked
+}
+
+// Key returns the snake_case key identifying the sensor in the MQTT payloads. The
+// names generated by the autodiscovery or received from the collectors are
+// sanitized, they hold mount points, unit names or labels.
+func (s *Sensor) Key() string {
+	if s.config.Discovered || s.config.Generated {
+		return sensorKey(s.config.Name)
+	}
+	return strcase.ToSnake(s.config.Name)
+}
+
+// sensorKey returns the snake_case key of a generated name, such as the name of a
+// discovered sensor or the identifier of a child device. Punctuation such as the
+// slashes of a mount point is replaced, so that the key can be used in the value
+// templates and the MQTT topics.
+func sensorKey(name string) string {
+	key := invalidKeyPattern.ReplaceAllString(strcase.ToSnake(name), "_")
+	return strings.Trim(key, "_")
+}
+
+// HasDeadband reports whether the sensor only publishes meaningful changes, in
+// which case its value can be missing from the state payload.
+func (s *Sensor) HasDeadband() bool {
+	return s.deadband != nil
+}
+
+// ShouldPublish reports whether the reading must be published, according to the
+// deadband of the sensor. Sensors without deadband publish every reading.
+func (s *Sensor) ShouldPublish(reading Reading) bool {
+	if reading.Err != nil {
+		return false
+	}
+	if s.deadband == nil {
+		return true
+	}
+	return s.deadband.shouldPublish(reading.Value, reading.Time)
+}
+
+// MarkPublished records the reading as the last value published by the sensor.
+func (s *Sensor) MarkPublished(reading Reading) {
+	if s.deadband != nil {
+		s.deadband.markPublished(reading.Value, reading.Time)
+	}
+}
+
+// IsEnum reports whether the sensor publishes text values instead of numbers.
+func (s *Sensor) IsEnum() bool {
+	return s.config.DeviceClass == "enum"
+}
+
+// HasAttributes reports whether the sensor publishes attributes along its value.
+func (s *Sensor) HasAttributes() bool {
+	return s.config.Attributes
+}
+
+// IsBinary reports whether the sensor is a binary sensor publishing ON or OFF.
+func (s *Sensor) IsBinary() bool {
+	return s.config.Platform == PLATFORM_BINARY_SENSOR
+}
+
+// IsEvent reports whether the sensor is an event entity, firing events on its own
+// topic instead of publishing a state.
+func (s *Sensor) IsEvent() bool {
+	return s.config.Platform == PLATFORM_EVENT
+}
+
+// IsButton reports whether the sensor is a button, receiving presses on its command
+// topic instead of publishing a state.
+func (s *Sensor) IsButton() bool {
+	return s.config.Platform == PLATFORM_BUTTON
+}
+
+// LastReading returns the reading of the last measurement of the sensor.
+func (s *Sensor) LastReading() Reading {
+	return s.last
+}
+
 // GetSensorValue retrieves the current value of the sensor after performing a measurement.
 // It returns the sensor value as a string if the measurement is successful, or an error
 // if the measurement fails.
-func (s *Sensor) GetSensorValue() (string, error) {
-	err := s.runMeasurement()
+func (s *Sensor) GetSensorValue(ctx context.Context) (string, error) {
+	err := s.runMeasurement(ctx)
 	if err != nil {
 		return "", err
 	}
 	return s.value, nil
 }
 
-func (s *Sensor) runMeasurement() error {
-	cmd := exec.Command("bash", "-c", s.config.Command)
+// Measure performs a measurement and returns it as a Reading ready to be published.
+// Numeric values are parsed, derived when the sensor is a counter, and rounded to
+// the precision of the sensor. Enum sensors keep their text value. Sampled sensors
+// do not run their command and publish their aggregate of the last window instead.
+// Stream sensors return the reading of the last line of their command already
+// collected by CollectStreams.
+func (s *Sensor) Measure(ctx context.Context) (reading Reading) {
+	if s.stream != nil {
+		s.last = s.stream.latest()
+		return s.last
+	}
+
+	start := time.Now()
+	reading.Time = start
+	defer func() {
+		reading.Duration = time.Since(start)
+		if s.attributes != nil {
+			reading.Attributes = s.attributes.collect(ctx, s.run)
+		}
+		s.last = reading
+	}()
+
+	if s.binary != nil {
+		on, err := s.binary.evaluate(ctx)
+		if err != nil {
+			reading.Err = err
+			return reading
+		}
+		reading.Value = formatBinaryState(on != s.invert)
+		return reading
+	}
+
+	if s.sampler != nil {
+		value, err := s.sampler.aggregate(s.aggregate)
+		if err != nil {
+			reading.Err = err
+			return reading
+		}
+		reading.Value = RoundValue(value, s.config.Precision)
+		return reading
+	}
+
+	value, err := s.GetSensorValue(ctx)
+	if err != nil {
+		reading.Err = err
+		return reading
+	}
+	reading.Value, reading.Err = s.parseValue(value, start)
+	return reading
+}
+
+// parseValue converts the transformed output of the command to the value
+// published by the sensor.
+func (s *Sensor) parseValue(value string, now time.Time) (any, error) {
+	if s.IsEnum() {
+		return value, nil
+	}
+
+	floatValue, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, fmt.Errorf("value %q is not numeric: %w", value, err)
+	}
+	if s.deriver != nil {
+		floatValue, err = s.deriver.apply(s.Device.GetStateStore(), floatValue, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return RoundValue(floatValue, s.config.Precision), nil
+}
+
+func (s *Sensor) runMeasurement(ctx context.Context) error {
+	cmd := shellCommand(ctx, s.config.Command)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	start := time.Now()
 	output, err := cmd.Output()
+	s.run = commandRun{
+		stderr:   stderr.String(),
+		exitCode: exitCode(err),
+		duration: time.Since(start),
+	}
+	if err != nil {
+		s.value = ""
+		return err
+	}
+
+	raw := string(output)
+	if s.config.ValueField != "" {
+		raw, s.run.fields, err = splitValueField(raw, s.config.ValueField)
+		if err != nil {
+			s.value = ""
+			return err
+		}
+	}
+
+	value, err := s.config.Transform.Apply(raw)
 	if err != nil {
 		s.value = ""
 		return err
 	}
-	s.value = strings.TrimSpace(string(output))
+	s.value = value
 	return nil
 }
+
+// exitCode returns the exit code of a command from the error of its run.
+// It returns -1 if the command could not be started at all.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"text/template"
+)
+
+// templateItem represents the data available to the templates of a sensor
+// repeated with `for_each`.
+//
+// Fields:
+// - Item: The current item, a scalar or a mapping of the list, or a line of the command output.
+// - Index: The position of the item, starting at 0.
+// - Fields: The whitespace separated fields of the item, when it is a text.
+type templateItem struct {
+	Item   any
+	Index  int
+	Fields []string
+}
+
+// ExpandSensorTemplates replaces every sensor template of the configuration by the
+// sensors it describes, one per item, in the order of the items. The sensors
+// without `for_each` are kept as they are.
+//
+// Parameters:
+//   - sensors: The sensors of the configuration file.
+//
+// Returns:
+//   - The sensors with their templates expanded.
+//   - An error if a template is invalid, its items cannot be listed, or it does not
+//     generate distinct keys.
+func ExpandSensorTemplates(sensors []SensorConfig) ([]SensorConfig, error) {
+	var expanded []SensorConfig
+	for _, sensor := range sensors {
+		if sensor.ForEach == nil {
+			expanded = append(expanded, sensor)
+			continue
+		}
+		generated, err := expandSensorTemplate(sensor)
+		if err != nil {
+			return nil, fmt.Errorf("sensor template %q: %w", sensor.Name, err)
+		}
+		expanded = append(expanded, generated...)
+	}
+	return expanded, nil
+}
+
+// expandSensorTemplate generates the sensors of a single template.
+func expandSensorTemplate(sensor SensorConfig) ([]SensorConfig, error) {
+	items, err := forEachItems(*sensor.ForEach)
+	if err != nil {
+		return nil, err
+	}
+
+	var generated []SensorConfig
+	keys := map[string]bool{}
+	for i, item := range items {
+		data := templateItem{Item: item, Index: i}
+		if text, ok := item.(string); ok {
+			data.Fields = strings.Fields(text)
+		}
+
+		concrete := sensor
+		concrete.ForEach = nil
+		// The items are often paths, the punctuation is removed from the keys
+		concrete.Generated = true
+		for _, field := range []struct {
+			name  string
+			value *string
+		}{
+			{"name", &concrete.Name},
+			{"command", &concrete.Command},
+			{"icon", &concrete.Icon},
+			{"unique_id", &concrete.UniqueID},
+		} {
+			if *field.value, err = renderTemplate(field.name, *field.value, data); err != nil {
+				return nil, err
+			}
+		}
+
+		key := sensorKey(concrete.Name)
+		if key == "" {
+			return nil, fmt.Errorf("item %d generates the name %q, which has no letter or digit", i, concrete.Name)
+		}
+		if keys[key] {
+			return nil, fmt.Errorf("item %d generates the key %q twice, from the name %q, the name must depend on the item", i, key, concrete.Name)
+		}
+		keys[key] = true
+		generated = append(generated, concrete)
+	}
+	return generated, nil
+}
+
+// forEachItems returns the items of a template: its static list, or the non-empty
+// output lines of its command.
+func forEachItems(forEach ForEachConfig) ([]any, error) {
+	if forEach.Command == "" {
+		return forEach.Items, nil
+	}
+	output, err := exec.Command("bash", "-c", forEach.Command).Output()
+	if err != nil {
+		return nil, fmt.Errorf("for_each command failed: %w", err)
+	}
+	var items []any
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			items = append(items, line)
+		}
+	}
+	return items, nil
+}
+
+// renderTemplate executes a text/template on the data of an item. Referring to a
+// missing field of a mapping item is an error.
+func renderTemplate(field string, text string, data templateItem) (string, error) {
+	if text == "" {
+		return "", nil
+	}
+	tmpl, err := template.New(field).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return "", err
+	}
+	return rendered.String(), nil
+}
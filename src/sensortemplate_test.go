@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSensorTemplateMountPointKeys(t *testing.T) {
+	sensors, err := ExpandSensorTemplates([]SensorConfig{{
+		Name:    "Disk Usage {{.Item}}",
+		Command: "df --output=pcent {{.Item}} | tail -1",
+		ForEach: &ForEachConfig{Items: []any{"/", "/home", "/var/lib/docker"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	device := NewDevice("Host", "Manufacturer", "Model", "host-sn")
+	want := []string{"disk_usage", "disk_usage_home", "disk_usage_var_lib_docker"}
+	if len(sensors) != len(want) {
+		t.Fatalf("%d sensors, want %d", len(sensors), len(want))
+	}
+	for i, cfg := range sensors {
+		sensor, err := NewSensorFromConfig(cfg, device)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sensor.Key() != want[i] {
+			t.Errorf("key of %q = %q, want %q", cfg.Name, sensor.Key(), want[i])
+		}
+		if template := valueTemplate(device, sensor); template != "{{ value_json."+want[i]+" }}" {
+			t.Errorf("value_template of %q = %q", cfg.Name, template)
+		}
+	}
+}
+
+func TestSensorTemplateItemsSharingKey(t *testing.T) {
+	_, err := ExpandSensorTemplates([]SensorConfig{{
+		Name:    "Queue {{.Item}}",
+		Command: "echo 1",
+		ForEach: &ForEachConfig{Items: []any{"a-b", "a_b"}},
+	}})
+	if err == nil || !strings.Contains(err.Error(), `"queue_a_b"`) {
+		t.Errorf("ExpandSensorTemplates() = %v, want an error about the key queue_a_b", err)
+	}
+}
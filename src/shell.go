@@ -0,0 +1,22 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"time"
+)
+
+// COMMAND_STOP_GRACE is the time a command is given to exit once its context is
+// cancelled, before being killed.
+const COMMAND_STOP_GRACE = 5 * time.Second
+
+// shellCommand returns the command running a command line of the configuration
+// file with bash. The command and the commands it starts are asked to exit when
+// the context is cancelled, on timeout or when the agent stops, and killed after
+// COMMAND_STOP_GRACE.
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "bash", "-c", command)
+	prepareProcessGroup(cmd)
+	cmd.WaitDelay = COMMAND_STOP_GRACE
+	return cmd
+}
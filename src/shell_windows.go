@@ -0,0 +1,14 @@
+//go:build windows
+
+package main
+
+import "os/exec"
+
+// prepareProcessGroup keeps the default behaviour on Windows, where the command is
+// killed when its context is cancelled.
+func prepareProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills the process of a command.
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
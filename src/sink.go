@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	SINK_TYPE_INFLUXDB      = "influxdb"
+	SINK_TYPE_FILE          = "file"
+	SINK_TYPE_STDOUT        = "stdout"
+	SINK_TYPE_HOMEASSISTANT = "homeassistant"
+	SINK_TYPE_WEBHOOK       = "webhook"
+
+	// DEFAULT_SINK_RETRIES is the number of times a failed request of a sink is
+	// retried when its configuration does not set one.
+	DEFAULT_SINK_RETRIES = 3
+	// SINK_RETRY_BACKOFF is the pause before the first retry, doubled before every
+	// following one up to SINK_RETRY_MAX_BACKOFF.
+	SINK_RETRY_BACKOFF     = time.Second
+	SINK_RETRY_MAX_BACKOFF = 30 * time.Second
+)
+
+// httpStatusError represents a request of a sink answered with an unexpected status.
+type httpStatusError struct {
+	status  int
+	message string
+}
+
+func (e *httpStatusError) Error() string {
+	return e.message
+}
+
+// newHTTPStatusError returns the error of a request answered with an unexpected
+// status, including the beginning of the answer which usually explains it.
+func newHTTPStatusError(action string, resp *http.Response) *httpStatusError {
+	message := fmt.Sprintf("%s failed: %s", action, resp.Status)
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if detail := strings.TrimSpace(string(body)); detail != "" {
+		message += ": " + detail
+	}
+	return &httpStatusError{status: resp.StatusCode, message: message}
+}
+
+// Sink is a destination of the readings of the device. The main loop hands every
+// snapshot to every sink, the failure of a sink does not affect the others.
+type Sink interface {
+	// Name returns the name of the sink, used in logs and metrics.
+	Name() string
+	// Publish sends the readings and the events of a snapshot of the device and of
+	// its children. The snapshots of the stream sensors only hold their new readings.
+	// The publication is abandoned when the context is cancelled.
+	Publish(ctx context.Context, device *Device, snapshot *Snapshot) error
+}
+
+// NewSinkFromConfig creates the sink described by an entry of the `sinks` section
+// of the configuration file, according to its type.
+func NewSinkFromConfig(cfg SinkConfig) (Sink, error) {
+	switch cfg.Type {
+	case SINK_TYPE_INFLUXDB:
+		return NewInfluxDBSink(cfg)
+	case SINK_TYPE_FILE:
+		return NewFileSink(cfg)
+	case SINK_TYPE_STDOUT:
+		return NewStdoutSink(), nil
+	case SINK_TYPE_HOMEASSISTANT:
+		return NewHomeAssistantSink(cfg)
+	case SINK_TYPE_WEBHOOK:
+		return NewWebhookSink(cfg)
+	}
+	return nil, fmt.Errorf("unknown sink type %q", cfg.Type)
+}
+
+// withRetry calls the function until it succeeds, retrying up to the given number of
+// times with an exponential backoff. Requests rejected by the server, such as those
+// with an invalid token, are not retried, unlike server errors and throttling. The
+// retries stop when the context is cancelled.
+func withRetry(ctx context.Context, retries int, call func() error) error {
+	backoff := SINK_RETRY_BACKOFF
+	for attempt := 0; ; attempt++ {
+		err := call()
+		var statusErr *httpStatusError
+		if err == nil || attempt >= retries ||
+			errors.As(err, &statusErr) && statusErr.status < 500 && statusErr.status != 429 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, SINK_RETRY_MAX_BACKOFF)
+	}
+}
+
+// MQTTSink is the Sink publishing the device to Home Assistant through an MQTT
+// server: the discovery messages, the values which changed enough according to
+// the deadband of their sensors, the attributes and the events. It subscribes to
+// the command topics when the device takes commands.
+//
+// Fields:
+// - proxy: The connection to the MQTT server.
+// - lastConfigSent: The time the discovery messages were last published.
+// - lastConfigRevision: The revision of the device announced by the last discovery messages.
+// - subscribed: The command topics subscribed, for the device and each of its children.
+// - events: The events waiting for their publication, kept while the server is unreachable.
+type MQTTSink struct {
+	proxy              *MQTTProxy
+	lastConfigSent     time.Time
+	lastConfigRevision int
+	subscribed         map[string]bool
+	events             []firedEvent
+}
+
+// NewMQTTSink creates a new MQTT sink publishing through the proxy.
+func NewMQTTSink(proxy *MQTTProxy) *MQTTSink {
+	return &MQTTSink{
+		proxy:              proxy,
+		lastConfigRevision: -1,
+		subscribed:         map[string]bool{},
+	}
+}
+
+// Name returns the name of the sink.
+func (s *MQTTSink) Name() string {
+	return "mqtt"
+}
+
+// Publish connects to the MQTT server if needed and publishes the snapshot. The
+// discovery messages are published again every CONFIG_REFRESH_PERIOD, or as soon
+// as the sensors change.
+func (s *MQTTSink) Publish(ctx context.Context, device *Device, snapshot *Snapshot) error {
+	s.events = append(s.events, snapshot.Events...)
+
+	// Connect to the MQTT server
+	if err := s.proxy.Connect(ctx); err != nil {
+		return err
+	}
+
+	// Receive the presses of the buttons, the subscriptions survive reconnections
+	if device.AcceptsCommands() {
+		if err := s.syncSubscriptions(ctx, device); err != nil {
+			return err
+		}
+	}
+
+	// Send configuration to the MQTT server if 15 minutes have elapsed or the sensors changed
+	if time.Since(s.lastConfigSent) > CONFIG_REFRESH_PERIOD || device.ConfigRevision() != s.lastConfigRevision {
+		if err := s.publishConfig(ctx, device); err != nil {
+			return err
+		}
+	}
+
+	for _, dev := range device.Devices() {
+		if err := s.publishDeviceSnapshot(ctx, dev, snapshot.Of(dev)); err != nil {
+			return err
+		}
+	}
+
+	// Publish the events fired since the previous publication, in order
+	for len(s.events) > 0 {
+		event := s.events[0]
+		mqttEvent, err := FormatMQTTEvent(event)
+		if err != nil {
+			return err
+		}
+		if err := s.proxy.Publish(ctx, GetEventTopic(event.sensor.Device, event.sensor), mqttEvent); err != nil {
+			return err
+		}
+		s.events = s.events[1:]
+	}
+	return nil
+}
+
+// Close disconnects from the MQTT server, announcing the agent as offline.
+func (s *MQTTSink) Close() {
+	s.proxy.Disconnect()
+}
+
+// IsConnected reports whether the sink is connected to the MQTT server.
+func (s *MQTTSink) IsConnected() bool {
+	return s.proxy.IsConnected()
+}
+
+// syncSubscriptions subscribes to the command topics of the device and of its
+// children, and unsubscribes from those of the children which are gone.
+func (s *MQTTSink) syncSubscriptions(ctx context.Context, device *Device) error {
+	current := map[string]bool{}
+	for _, dev := range device.Devices() {
+		topic := GetCommandSubscription(dev)
+		current[topic] = true
+		if s.subscribed[topic] {
+			continue
+		}
+		err := s.proxy.Subscribe(ctx, topic, func(client mqtt.Client, message mqtt.Message) {
+			device.QueueCommand(message.Topic(), string(message.Payload()))
+		})
+		if err != nil {
+			return err
+		}
+		s.subscribed[topic] = true
+	}
+	for topic := range s.subscribed {
+		if current[topic] {
+			continue
+		}
+		if err := s.proxy.Unsubscribe(ctx, topic); err != nil {
+			return err
+		}
+		delete(s.subscribed, topic)
+	}
+	return nil
+}
+
+// publishConfig publishes the discovery messages of the device and of its children.
+func (s *MQTTSink) publishConfig(ctx context.Context, device *Device) error {
+
+	// An empty configuration removes the child devices which are gone
+	for _, removed := range device.TakeRemovedChildren() {
+		if err := s.proxy.Publish(ctx, GetConfigTopic(removed), ""); err != nil {
+			return err
+		}
+	}
+	// The parent is announced first, its children refer to it
+	for _, dev := range device.Devices() {
+		// Format the MQTT config payload
+		mqttConfig, err := FormatMQTTConfig(dev)
+		if err != nil {
+			return err
+		}
+		if err := s.proxy.Publish(ctx, GetConfigTopic(dev), mqttConfig); err != nil {
+			return err
+		}
+		dev.ForgetRemovedComponents()
+	}
+	slog.Info("Configuration sent to the MQTT server", "devices", len(device.Devices()))
+	s.lastConfigSent = time.Now()
+	s.lastConfigRevision = device.ConfigRevision()
+	return nil
+}
+
+// publishDeviceSnapshot publishes the readings of a single device which must be
+// published, along with the attributes of their sensors.
+func (s *MQTTSink) publishDeviceSnapshot(ctx context.Context, device *Device, snapshot *Snapshot) error {
+	// Only keep the values which changed enough or reached their heartbeat
+	published := device.FilterPublishable(snapshot)
+	if len(published.Readings) == 0 {
+		// Child devices without change are common, only the device itself is reported
+		if device.GetParent() == nil {
+			slog.Debug("No sensor value changed, nothing to send")
+		}
+	} else {
+		// Format the MQTT values payload
+		mqttValues, err := FormatMQTTValues(device, published)
+		if err != nil {
+			return err
+		}
+
+		// Publish sensor values to the MQTT server
+		if err := s.proxy.Publish(ctx, GetStateTopic(device), mqttValues); err != nil {
+			return err
+		}
+		device.MarkPublished(published)
+		slog.Debug("Sensor values sent to the MQTT server", "device", device.GetDeviceInfo().Name, "topic", GetStateTopic(device), "values", len(published.Readings))
+	}
+
+	// Publish the attributes along the published values, and on errors so
+	// that the diagnostics explain them
+	for _, sensor := range device.GetSensors() {
+		if !sensor.HasAttributes() {
+			continue
+		}
+		reading, ok := published.Readings[sensor.Key()]
+		if !ok {
+			reading = snapshot.Readings[sensor.Key()]
+			if reading.Err == nil {
+				continue
+			}
+		}
+		mqttAttributes, err := FormatMQTTAttributes(reading)
+		if err != nil {
+			return err
+		}
+		if err := s.proxy.Publish(ctx, GetAttributesTopic(device, sensor), mqttAttributes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNoValue is reported by sensors which do not have a value to publish yet,
+// for example a rate sensor waiting for its second sample.
+var ErrNoValue = errors.New("no value available yet")
+
+// Reading represents the result of a single sensor measurement.
+//
+// Fields:
+// - Value: The measured value, a float64 for numeric sensors or a string for enum sensors.
+// - Err: The error raised during the measurement, if any.
+// - Time: The time at which the measurement was taken.
+// - Duration: The time taken by the measurement.
+// - Attributes: The attributes of the sensor, or nil if the sensor has none.
+type Reading struct {
+	Value      any
+	Err        error
+	Time       time.Time
+	Duration   time.Duration
+	Attributes map[string]any
+}
+
+// Snapshot holds the readings of every sensor of a device for a single cycle.
+// Readings are indexed by the snake_case key of their sensor. The readings of the
+// child devices are kept in their own snapshots. The events fired during the cycle
+// by the event entities of the device and of its children are kept in order.
+type Snapshot struct {
+	Time     time.Time
+	Readings map[string]Reading
+	Children map[*Device]*Snapshot
+	Events   []firedEvent
+}
+
+// NewSnapshot creates an empty snapshot taken at the current time.
+func NewSnapshot() *Snapshot {
+	return &Snapshot{
+		Time:     time.Now(),
+		Readings: map[string]Reading{},
+	}
+}
+
+// Of returns the readings of the given device: the snapshot itself for the device
+// it was taken from, or the snapshot of a child device, empty if it has no readings.
+func (s *Snapshot) Of(device *Device) *Snapshot {
+	if device.GetParent() == nil {
+		return s
+	}
+	if s.Children == nil {
+		s.Children = map[*Device]*Snapshot{}
+	}
+	child, ok := s.Children[device]
+	if !ok {
+		child = &Snapshot{Time: s.Time, Readings: map[string]Reading{}}
+		s.Children[device] = child
+	}
+	return child
+}
+
+// mergeReadings returns the last reading of every current sensor of the device and
+// of its children: the reading of the snapshot, or the previous one for the sensors
+// missing from it, such as in the partial snapshots of the stream sensors. Sensors
+// removed by the collectors are dropped.
+func mergeReadings(device *Device, snapshot *Snapshot, previous map[*Sensor]Reading) map[*Sensor]Reading {
+	readings := map[*Sensor]Reading{}
+	for _, dev := range device.Devices() {
+		for _, sensor := range dev.GetSensors() {
+			reading, ok := snapshot.Of(dev).Readings[sensor.Key()]
+			if !ok {
+				reading, ok = previous[sensor]
+			}
+			if ok {
+				readings[sensor] = reading
+			}
+		}
+	}
+	return readings
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// counterState represents the persisted state of a derived counter sensor.
+//
+// Fields:
+// - Value: The last raw counter value.
+// - Time: The time at which the last raw value was sampled.
+// - Total: The accumulated increments of the counter (used by `derive: total`).
+type counterState struct {
+	Value float64   `json:"value"`
+	Time  time.Time `json:"time"`
+	Total float64   `json:"total"`
+}
+
+// StateStore keeps the state of stateful sensors and persists it in a JSON file
+// so that it survives restarts. A store without a path only lives in memory.
+type StateStore struct {
+	path     string
+	mu       sync.Mutex
+	counters map[string]counterState
+	dirty    bool
+}
+
+// NewStateStore creates an empty state store persisted at the given path.
+// An empty path creates an in-memory store.
+func NewStateStore(path string) *StateStore {
+	return &StateStore{
+		path:     path,
+		counters: map[string]counterState{},
+	}
+}
+
+// LoadStateStore creates a state store persisted at the given path and loads its
+// previous content. A missing file is not an error, the store simply starts empty.
+//
+// Parameters:
+//   - path: The path of the JSON state file, or an empty string to disable persistence.
+//
+// Returns:
+//   - *StateStore: A pointer to the loaded store.
+//   - error: An error if the file exists but cannot be read or decoded.
+func LoadStateStore(path string) (*StateStore, error) {
+	store := NewStateStore(path)
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+	if err := json.Unmarshal(data, &store.counters); err != nil {
+		return nil, fmt.Errorf("failed to decode state file: %w", err)
+	}
+	return store, nil
+}
+
+// getCounter returns the stored state of the counter with the given key.
+func (s *StateStore) getCounter(key string) (counterState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.counters[key]
+	return state, ok
+}
+
+// setCounter stores the state of the counter with the given key.
+func (s *StateStore) setCounter(key string, state counterState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counters[key] = state
+	s.dirty = true
+}
+
+// Save writes the store to its file if it changed since the last save.
+// The file is replaced atomically so that a crash never leaves a truncated state.
+func (s *StateStore) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.path == "" || !s.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(s.counters)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("failed to replace state file: %w", err)
+	}
+	s.dirty = false
+	return nil
+}
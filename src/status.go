@@ -0,0 +1,383 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// HEALTHY_MISSED_CYCLES is the number of refresh periods without collection
+	// after which the agent is reported unhealthy.
+	HEALTHY_MISSED_CYCLES = 3
+
+	// STATUS_TOKEN_COOKIE holds the token of the browsers, set once they logged in.
+	STATUS_TOKEN_COOKIE = "penguinhomelink_token"
+)
+
+// sensorStatus represents the last reading of a sensor in the status.
+type sensorStatus struct {
+	Name      string     `json:"name"`
+	Key       string     `json:"key"`
+	Value     any        `json:"value"`
+	Unit      string     `json:"unit,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Time      *time.Time `json:"time,omitempty"`
+	DurationS float64    `json:"duration_s"`
+}
+
+// deviceStatus represents a device and its sensors in the status.
+type deviceStatus struct {
+	Name    string         `json:"name"`
+	Serial  string         `json:"serial"`
+	Sensors []sensorStatus `json:"sensors"`
+}
+
+// sinkStatus represents the last publication to a sink in the status. Connected
+// is only set for the sinks keeping a connection, such as MQTT.
+type sinkStatus struct {
+	Name        string    `json:"name"`
+	OK          bool      `json:"ok"`
+	Error       string    `json:"error,omitempty"`
+	LastPublish time.Time `json:"last_publish"`
+	Connected   *bool     `json:"connected,omitempty"`
+}
+
+// agentStatus represents the answer of the /status endpoint.
+type agentStatus struct {
+	Version        string         `json:"version"`
+	Started        time.Time      `json:"started"`
+	Healthy        bool           `json:"healthy"`
+	Cycles         int            `json:"cycles"`
+	LastCycle      *time.Time     `json:"last_cycle"`
+	CycleDurationS float64        `json:"cycle_duration_s"`
+	Sinks          []sinkStatus   `json:"sinks"`
+	Devices        []deviceStatus `json:"devices"`
+}
+
+// statusPage is the template of the HTML page of the status API.
+var statusPage = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="30">
+<title>PenguinHomeLink</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+.error { color: #b00020; }
+</style>
+</head>
+<body>
+<h1>PenguinHomeLink {{.Status.Version}}</h1>
+<p>
+{{if .Status.Healthy}}Healthy{{else}}<span class="error">Unhealthy</span>{{end}},
+{{.Status.Cycles}} cycles since {{.Status.Started.Format "2006-01-02 15:04:05"}}.
+{{with .Status.LastCycle}}Last cycle at {{.Format "15:04:05"}}{{end}}
+</p>
+<form method="post" action="/trigger"><button type="submit">Collect now</button></form>
+<h2>Sinks</h2>
+<table>
+<tr><th>Sink</th><th>Status</th><th>Last publication</th></tr>
+{{range .Status.Sinks}}<tr>
+<td>{{.Name}}</td>
+<td>{{if .OK}}OK{{else}}<span class="error">{{.Error}}</span>{{end}}</td>
+<td>{{.LastPublish.Format "15:04:05"}}</td>
+</tr>{{end}}
+</table>
+{{range .Status.Devices}}<h2>{{.Name}} <small>{{.Serial}}</small></h2>
+<table>
+<tr><th>Sensor</th><th>Value</th><th>Duration</th><th>Time</th></tr>
+{{range .Sensors}}<tr>
+<td>{{.Name}}</td>
+<td>{{if .Error}}<span class="error">{{.Error}}</span>{{else}}{{.Value}} {{.Unit}}{{end}}</td>
+<td>{{printf "%.3f" .DurationS}} s</td>
+<td>{{with .Time}}{{.Format "15:04:05"}}{{end}}</td>
+</tr>{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`))
+
+// loginPage is the template of the HTML page asking the browsers for the token.
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>PenguinHomeLink</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+.error { color: #b00020; }
+</style>
+</head>
+<body>
+<h1>PenguinHomeLink</h1>
+{{if .}}<p class="error">{{.}}</p>{{end}}
+<form method="post" action="/login">
+<label>Token <input type="password" name="token" autofocus></label>
+<button type="submit">Log in</button>
+</form>
+</body>
+</html>
+`))
+
+// StatusServer is a local HTTP server showing what the agent sees: the last
+// reading of every sensor, the state of the sinks and the last cycle, as JSON on
+// /status or as an HTML page on /. It also answers health checks on /healthz and
+// starts a collection cycle on POST /trigger. Every endpoint but /healthz requires
+// the bearer token when one is configured. Browsers post it once to /login, which
+// keeps it in a cookie.
+//
+// Fields:
+// - localServer: The HTTP server.
+// - device: The device, whose collections are requested by /trigger.
+// - token: The bearer token, or empty to not require one.
+// - refreshPeriod: The refresh period of the main loop, used by the health checks.
+// - readings: The last reading of every sensor, for the partial snapshots of the stream sensors.
+// - mu: Guards the fields below, read by the HTTP server.
+// - status: The status, rendered by the last update.
+type StatusServer struct {
+	*localServer
+	device        *Device
+	token         string
+	refreshPeriod time.Duration
+	readings      map[*Sensor]Reading
+
+	mu     sync.Mutex
+	status agentStatus
+}
+
+// NewStatusServer creates the status server and binds its listener. It serves
+// nothing until Start.
+//
+// Parameters:
+//   - cfg: The status_api section of the configuration file.
+//   - device: The device whose status is served.
+//   - refreshPeriod: The refresh period of the main loop, in seconds.
+//
+// Returns:
+//   - A pointer to the newly created StatusServer instance.
+//   - An error if the address is missing or cannot be bound.
+func NewStatusServer(cfg StatusAPIConfig, device *Device, refreshPeriod int) (*StatusServer, error) {
+	status := &StatusServer{
+		device:        device,
+		token:         cfg.Token,
+		refreshPeriod: time.Duration(refreshPeriod) * time.Second,
+		readings:      map[*Sensor]Reading{},
+		status: agentStatus{
+			Version: SOFTWARE_VERSION,
+			Started: time.Now(),
+		},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", status.serveHealth)
+	mux.HandleFunc("GET /status", status.authorized(status.serveStatus))
+	mux.HandleFunc("GET /{$}", status.authorized(status.servePage))
+	mux.HandleFunc("POST /trigger", status.authorized(status.serveTrigger))
+	mux.HandleFunc("POST /login", status.serveLogin)
+	server, err := newLocalServer("status_api", cfg.Listen, mux)
+	if err != nil {
+		return nil, err
+	}
+	status.localServer = server
+	return status, nil
+}
+
+// Update records the readings of a snapshot of the device. Partial snapshots, such
+// as those of the stream sensors, only replace the readings they hold.
+func (s *StatusServer) Update(device *Device, snapshot *Snapshot) {
+	s.readings = mergeReadings(device, snapshot, s.readings)
+	var devices []deviceStatus
+	for _, dev := range device.Devices() {
+		status := deviceStatus{
+			Name:    dev.GetDeviceInfo().Name,
+			Serial:  dev.GetDeviceInfo().SerialNumber,
+			Sensors: []sensorStatus{},
+		}
+		for _, sensor := range dev.GetSensors() {
+			reading, ok := s.readings[sensor]
+			if !ok {
+				continue
+			}
+			sensorStatus := sensorStatus{
+				Name:      sensor.config.Name,
+				Key:       sensor.Key(),
+				Value:     reading.Value,
+				Unit:      sensor.config.UnitOfMeasurement,
+				DurationS: reading.Duration.Seconds(),
+			}
+			if reading.Err != nil {
+				sensorStatus.Error = reading.Err.Error()
+			}
+			if !reading.Time.IsZero() {
+				sensorStatus.Time = &reading.Time
+			}
+			status.Sensors = append(status.Sensors, sensorStatus)
+		}
+		devices = append(devices, status)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Devices = devices
+}
+
+// RecordCycle records the end of a collection cycle.
+func (s *StatusServer) RecordCycle(start time.Time, duration time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Cycles++
+	s.status.LastCycle = &start
+	s.status.CycleDurationS = duration.Seconds()
+}
+
+// SetSinkStatus records the result of the last publication to a sink, and whether
+// it is connected for the sinks keeping a connection.
+func (s *StatusServer) SetSinkStatus(sink Sink, err error) {
+	status := sinkStatus{Name: sink.Name(), OK: err == nil, LastPublish: time.Now()}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	if connected, ok := sink.(interface{ IsConnected() bool }); ok {
+		isConnected := connected.IsConnected()
+		status.Connected = &isConnected
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.status.Sinks {
+		if s.status.Sinks[i].Name == status.Name {
+			s.status.Sinks[i] = status
+			return
+		}
+	}
+	s.status.Sinks = append(s.status.Sinks, status)
+}
+
+// currentStatus returns a copy of the status, with its health.
+func (s *StatusServer) currentStatus() agentStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := s.status
+	status.Sinks = append([]sinkStatus{}, s.status.Sinks...)
+	if status.Devices == nil {
+		status.Devices = []deviceStatus{}
+	}
+
+	// The first cycle may still be running, it is given the same delay
+	lastActivity := status.Started
+	if status.LastCycle != nil {
+		lastActivity = *status.LastCycle
+	}
+	status.Healthy = time.Since(lastActivity) < HEALTHY_MISSED_CYCLES*s.refreshPeriod
+	return status
+}
+
+// authorized wraps a handler to require the bearer token, from the Authorization
+// header or from the cookie of the browsers. The browsers asking for the HTML page
+// without the token are shown the login page.
+func (s *StatusServer) authorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.token != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok {
+				if cookie, err := r.Cookie(STATUS_TOKEN_COOKIE); err == nil {
+					token = cookie.Value
+				}
+			}
+			if !s.validToken(token) {
+				if r.Method == http.MethodGet && r.URL.Path == "/" {
+					s.serveLoginPage(w, "")
+					return
+				}
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
+
+// validToken reports whether a token is the configured one.
+func (s *StatusServer) validToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+// serveLogin checks the token posted by the login page and keeps it in a cookie,
+// so that it never appears in the URLs.
+func (s *StatusServer) serveLogin(w http.ResponseWriter, r *http.Request) {
+	token := r.PostFormValue("token")
+	if s.token != "" && !s.validToken(token) {
+		s.serveLoginPage(w, "Invalid token")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     STATUS_TOKEN_COOKIE,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// serveLoginPage answers the login page, with an optional error.
+func (s *StatusServer) serveLoginPage(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusUnauthorized)
+	if err := loginPage.Execute(w, message); err != nil {
+		slog.Warn("Error serving the login page", "error", err)
+	}
+}
+
+// serveHealth answers the health checks: 200 while the collection cycles run,
+// 503 once several refresh periods passed without one.
+func (s *StatusServer) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if !s.currentStatus().Healthy {
+		http.Error(w, "no collection cycle for too long", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// serveStatus answers the status as JSON.
+func (s *StatusServer) serveStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(s.currentStatus()); err != nil {
+		slog.Warn("Error serving the status", "error", err)
+	}
+}
+
+// servePage answers the status as an HTML page.
+func (s *StatusServer) servePage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := statusPage.Execute(w, map[string]any{
+		"Status": s.currentStatus(),
+	})
+	if err != nil {
+		slog.Warn("Error serving the status page", "error", err)
+	}
+}
+
+// serveTrigger requests an immediate collection cycle. The form of the HTML page is
+// sent back to the page.
+func (s *StatusServer) serveTrigger(w http.ResponseWriter, r *http.Request) {
+	s.device.RequestCollection()
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, "collection requested")
+}
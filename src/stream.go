@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SENSOR_TYPE_STREAM = "stream"
+
+	// STREAM_MIN_BACKOFF and STREAM_MAX_BACKOFF bound the delay before restarting
+	// the command of a stream sensor which exited. The delay doubles after each
+	// exit, and is reset once the command ran for STREAM_MAX_BACKOFF.
+	STREAM_MIN_BACKOFF = time.Second
+	STREAM_MAX_BACKOFF = time.Minute
+	// STREAM_QUEUE_SIZE is the number of readings of a stream sensor waiting for
+	// their publication. The oldest one is dropped when a line comes in while the
+	// queue is full.
+	STREAM_QUEUE_SIZE = 100
+)
+
+// streamer keeps the command of a stream sensor running and turns every line it
+// prints into a reading.
+//
+// Fields:
+// - command: The long-running command.
+// - process: Turns a line printed by the command into a reading.
+// - notify: Called after every new reading.
+// - mu: Protects last and queue, written by the reading goroutine.
+// - last: The reading of the last line taken by the device, ErrNoValue until the first one.
+// - queue: The readings of the lines not taken by the device yet, in order.
+// - cancel: Stops the command, set once started.
+// - done: Closed once the command stopped for good.
+type streamer struct {
+	command string
+	process func(line string, now time.Time) Reading
+	notify  func()
+
+	mu    sync.Mutex
+	last  Reading
+	queue []Reading
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// newStreamer creates a streamer for the given command. It does not start it.
+func newStreamer(command string, process func(line string, now time.Time) Reading, notify func()) *streamer {
+	return &streamer{
+		command: command,
+		process: process,
+		notify:  notify,
+		last:    Reading{Err: ErrNoValue},
+	}
+}
+
+// start launches the command in the background, restarting it whenever it exits.
+func (s *streamer) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	go s.loop(ctx)
+}
+
+// halt stops the command and waits for it to exit.
+func (s *streamer) halt() {
+	if s.cancel == nil {
+		return
+	}
+	s.cancel()
+	<-s.done
+}
+
+// latest returns the reading of the last line taken. The lines still queued are
+// left for take, so that they are published in order.
+func (s *streamer) latest() Reading {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+// take returns the readings of the lines not taken yet, in order.
+func (s *streamer) take() []Reading {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queue := s.queue
+	s.queue = nil
+	if len(queue) > 0 {
+		s.last = queue[len(queue)-1]
+	}
+	return queue
+}
+
+// loop runs the command until the context is cancelled.
+func (s *streamer) loop(ctx context.Context) {
+	defer close(s.done)
+	backoff := STREAM_MIN_BACKOFF
+	for {
+		start := time.Now()
+		err := s.run(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) >= STREAM_MAX_BACKOFF {
+			backoff = STREAM_MIN_BACKOFF
+		}
+		slog.Warn("Stream command exited, restarting", "command", s.command, "error", err, "backoff", backoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, STREAM_MAX_BACKOFF)
+	}
+}
+
+// run starts the command once and processes its lines until it exits.
+func (s *streamer) run(ctx context.Context) error {
+	cmd := shellCommand(ctx, s.command)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		reading := s.process(line, time.Now())
+		s.mu.Lock()
+		if len(s.queue) == STREAM_QUEUE_SIZE {
+			slog.Warn("Stream queue full, dropping the oldest line", "command", s.command)
+			s.queue = s.queue[1:]
+		}
+		s.queue = append(s.queue, reading)
+		s.mu.Unlock()
+		s.notify()
+	}
+	if err := cmd.Wait(); err != nil {
+		return err
+	}
+	return scanner.Err()
+}
+
+// processLine turns a line printed by the command of a stream sensor into a
+// reading, through the same pipeline as the output of a command sensor.
+func (s *Sensor) processLine(line string, now time.Time) Reading {
+	reading := Reading{Time: now}
+	value, err := s.config.Transform.Apply(line)
+	if err != nil {
+		reading.Err = err
+		return reading
+	}
+	reading.Value, reading.Err = s.parseValue(value, now)
+	return reading
+}
+
+// IsStream reports whether the sensor publishes the lines of a long-running
+// command as they come, in which case its value can be missing from the state
+// payload.
+func (s *Sensor) IsStream() bool {
+	return s.stream != nil
+}
+
+// hasStreams reports whether the device has stream sensors, whose readings are
+// published on the state topic without the readings of the other sensors.
+func (d *Device) hasStreams() bool {
+	return slices.ContainsFunc(d.sensors, (*Sensor).IsStream)
+}
+
+// notifyUpdate wakes up the consumer of the device's updates, without blocking
+// if a previous update is still pending. The updates of child devices are
+// consumed through their parent.
+func (d *Device) notifyUpdate() {
+	select {
+	case d.root().updates <- struct{}{}:
+	default:
+	}
+}
+
+// Updates returns a channel receiving a value when stream sensors have new
+// readings, to be fetched with CollectStreams. A single value may stand for
+// several readings.
+func (d *Device) Updates() <-chan struct{} {
+	return d.updates
+}
+
+// CollectStreams returns the snapshots holding the new readings of the stream
+// sensors of the device and of its children since their last collection, to be
+// published in order: the n-th snapshot holds the n-th new reading of every sensor.
+func (d *Device) CollectStreams() []*Snapshot {
+	var snapshots []*Snapshot
+	for _, device := range d.Devices() {
+		for _, sensor := range device.sensors {
+			if sensor.stream == nil {
+				continue
+			}
+			for i, reading := range sensor.stream.take() {
+				if i == len(snapshots) {
+					snapshots = append(snapshots, NewSnapshot())
+				}
+				sensor.last = reading
+				snapshots[i].Of(device).Readings[sensor.Key()] = reading
+			}
+		}
+	}
+	return snapshots
+}
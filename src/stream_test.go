@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestStreamDeviceValueTemplates(t *testing.T) {
+	device := NewDevice("Host", "Manufacturer", "Model", "host-sn")
+	var sensors []*Sensor
+	for _, cfg := range []SensorConfig{
+		{Name: "Last Login", Type: SENSOR_TYPE_STREAM, Command: "journalctl -f -n 0 -o cat", DeviceClass: "enum"},
+		{Name: "Load", Command: "cut -d ' ' -f 1 /proc/loadavg"},
+	} {
+		sensor, err := NewSensorFromConfig(cfg, device)
+		if err != nil {
+			t.Fatal(err)
+		}
+		device.AddSensor(sensor)
+		sensors = append(sensors, sensor)
+	}
+
+	// The payloads of the lines only hold the stream sensor, the load must keep its state
+	for _, sensor := range sensors {
+		key := sensor.Key()
+		want := "{{ value_json." + key + " if value_json." + key + " is defined else this.state }}"
+		if got := valueTemplate(device, sensor); got != want {
+			t.Errorf("value_template of %s = %q, want %q", key, got, want)
+		}
+	}
+
+	other := NewDevice("Other", "Manufacturer", "Model", "other-sn")
+	sensor, err := NewSensorFromConfig(SensorConfig{Name: "Load", Command: "cut -d ' ' -f 1 /proc/loadavg"}, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.AddSensor(sensor)
+	if got := valueTemplate(other, sensor); got != "{{ value_json.load }}" {
+		t.Errorf("value_template without stream = %q", got)
+	}
+}
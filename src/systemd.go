@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SYSTEMCTL_TIMEOUT is the time systemctl is given to answer.
+const SYSTEMCTL_TIMEOUT = 10 * time.Second
+
+// systemdUnitProperties lists the properties of the units read with systemctl show.
+var systemdUnitProperties = []string{"Id", "Description", "LoadState", "ActiveState", "SubState", "NRestarts"}
+
+// SystemdUnits is a Collector publishing the state of systemd units: their active
+// state and sub-state as enums, their number of automatic restarts, and the number
+// of failed units of the host.
+//
+// Fields:
+// - units: The names of the monitored units, with their type.
+type SystemdUnits struct {
+	units []string
+}
+
+// NewSystemdUnits creates a new systemd collector from its configuration file section.
+// Unit names without a type are services.
+func NewSystemdUnits(cfg SystemdUnitsConfig) (*SystemdUnits, error) {
+	collector := &SystemdUnits{}
+	for _, unit := range cfg.Units {
+		unit = strings.TrimSpace(unit)
+		if unit == "" {
+			return nil, fmt.Errorf("systemd_units: empty unit name")
+		}
+		if !strings.Contains(unit, ".") {
+			unit += ".service"
+		}
+		collector.units = append(collector.units, unit)
+	}
+	return collector, nil
+}
+
+// Name returns the name of the collector.
+func (s *SystemdUnits) Name() string {
+	return "systemd"
+}
+
+// Collect queries systemctl and returns the entities of the units and of the
+// failed units count.
+func (s *SystemdUnits) Collect(ctx context.Context) ([]CollectedEntity, error) {
+	output, err := runSystemctl(ctx, "list-units", "--state=failed", "--all", "--output=json", "--no-legend", "--no-pager")
+	if err != nil {
+		return nil, err
+	}
+	failed, err := parseFailedUnits(output)
+	if err != nil {
+		return nil, err
+	}
+	entities := []CollectedEntity{{
+		Name:       "Failed Units",
+		StateClass: "measurement",
+		Icon:       "mdi:alert-circle",
+		Value:      float64(len(failed)),
+		Attributes: map[string]any{"units": failed},
+	}}
+	if len(s.units) == 0 {
+		return entities, nil
+	}
+
+	args := []string{"show", "--property=" + strings.Join(systemdUnitProperties, ","), "--no-pager", "--"}
+	output, err = runSystemctl(ctx, append(args, s.units...)...)
+	if err != nil {
+		return nil, err
+	}
+	units := parseSystemctlShow(output)
+	if len(units) != len(s.units) {
+		return nil, fmt.Errorf("systemctl show returned %d units instead of %d", len(units), len(s.units))
+	}
+
+	for i, unit := range units {
+		entities = append(entities, unitEntities(s.units[i], unit)...)
+	}
+	return entities, nil
+}
+
+// unitEntities returns the entities of a monitored unit, named after the unit
+// without its .service suffix, from its properties printed by systemctl show.
+func unitEntities(unitName string, unit map[string]string) []CollectedEntity {
+	name := strings.TrimSuffix(unitName, ".service")
+	entities := []CollectedEntity{
+		{
+			Name:        name + " Active State",
+			DeviceClass: "enum",
+			Icon:        "mdi:cog",
+			Value:       unit["ActiveState"],
+			Attributes: map[string]any{
+				"description": unit["Description"],
+				"load_state":  unit["LoadState"],
+			},
+		},
+		{
+			Name:        name + " Sub State",
+			DeviceClass: "enum",
+			Icon:        "mdi:cog-outline",
+			Value:       unit["SubState"],
+		},
+	}
+	// Only services restart, other unit types have no restart counter
+	if restarts, err := strconv.ParseFloat(unit["NRestarts"], 64); err == nil {
+		entities = append(entities, CollectedEntity{
+			Name:       name + " Restarts",
+			StateClass: "total_increasing",
+			Icon:       "mdi:restart",
+			Value:      restarts,
+		})
+	}
+	return entities
+}
+
+// runSystemctl runs systemctl with the given arguments and returns its output.
+func runSystemctl(ctx context.Context, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, SYSTEMCTL_TIMEOUT)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "systemctl", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return "", fmt.Errorf("systemctl timed out after %s", SYSTEMCTL_TIMEOUT)
+	}
+	if err != nil {
+		return "", fmt.Errorf("systemctl %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return string(output), nil
+}
+
+// parseSystemctlShow parses the output of systemctl show for several units: blocks
+// of Key=Value lines separated by empty lines, in the order of the units.
+func parseSystemctlShow(output string) []map[string]string {
+	var units []map[string]string
+	var unit map[string]string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			unit = nil
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		if unit == nil {
+			unit = map[string]string{}
+			units = append(units, unit)
+		}
+		unit[key] = value
+	}
+	return units
+}
+
+// parseFailedUnits returns the names of the failed units from the output of
+// systemctl list-units --output=json. Versions of systemd older than 246 ignore
+// the JSON output and print one unit per line instead.
+func parseFailedUnits(output string) ([]string, error) {
+	output = strings.TrimSpace(output)
+	failed := []string{}
+	if strings.HasPrefix(output, "[") {
+		var units []struct {
+			Unit string `json:"unit"`
+		}
+		if err := json.Unmarshal([]byte(output), &units); err != nil {
+			return nil, fmt.Errorf("invalid systemctl output: %w", err)
+		}
+		for _, unit := range units {
+			failed = append(failed, unit.Unit)
+		}
+		return failed, nil
+	}
+	for _, line := range strings.Split(output, "\n") {
+		// Failed units are prefixed with a bullet in the plain output
+		fields := strings.Fields(strings.TrimLeft(line, "● *"))
+		if len(fields) > 0 {
+			failed = append(failed, fields[0])
+		}
+	}
+	return failed, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// systemctlShowOutput is the output of systemctl show --property=Id,Description,
+// LoadState,ActiveState,SubState,NRestarts for a service, a timer, a unit which
+// does not exist and a transient service without description, as printed by
+// systemd 252. The properties of the service type come first, timers have no
+// restart counter.
+const systemctlShowOutput = `NRestarts=2
+Id=nginx.service
+Description=A high performance web server and a reverse proxy server
+LoadState=loaded
+ActiveState=active
+SubState=running
+
+Id=backup.timer
+Description=Daily backup
+LoadState=loaded
+ActiveState=active
+SubState=waiting
+
+NRestarts=0
+Id=missing.service
+Description=missing.service
+LoadState=not-found
+ActiveState=inactive
+SubState=dead
+
+NRestarts=0
+Id=run-u42.service
+Description=
+LoadState=loaded
+ActiveState=failed
+SubState=failed
+`
+
+func TestParseSystemctlShow(t *testing.T) {
+	want := []map[string]string{
+		{
+			"NRestarts":   "2",
+			"Id":          "nginx.service",
+			"Description": "A high performance web server and a reverse proxy server",
+			"LoadState":   "loaded",
+			"ActiveState": "active",
+			"SubState":    "running",
+		},
+		{
+			"Id":          "backup.timer",
+			"Description": "Daily backup",
+			"LoadState":   "loaded",
+			"ActiveState": "active",
+			"SubState":    "waiting",
+		},
+		{
+			"NRestarts":   "0",
+			"Id":          "missing.service",
+			"Description": "missing.service",
+			"LoadState":   "not-found",
+			"ActiveState": "inactive",
+			"SubState":    "dead",
+		},
+		{
+			"NRestarts":   "0",
+			"Id":          "run-u42.service",
+			"Description": "",
+			"LoadState":   "loaded",
+			"ActiveState": "failed",
+			"SubState":    "failed",
+		},
+	}
+	if got := parseSystemctlShow(systemctlShowOutput); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseSystemctlShow() = %v, want %v", got, want)
+	}
+}
+
+func TestParseSystemctlShowSingleUnit(t *testing.T) {
+	output := "Id=sshd.service\r\nDescription=OpenSSH server daemon\r\nSubState=running\r\n"
+	want := []map[string]string{{
+		"Id":          "sshd.service",
+		"Description": "OpenSSH server daemon",
+		"SubState":    "running",
+	}}
+	if got := parseSystemctlShow(output); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseSystemctlShow() = %v, want %v", got, want)
+	}
+	if got := parseSystemctlShow(""); len(got) != 0 {
+		t.Errorf("parseSystemctlShow(\"\") = %v, want no unit", got)
+	}
+}
+
+func TestParseFailedUnits(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   []string
+	}{
+		{
+			// systemctl list-units --state=failed --all --output=json --no-legend --no-pager
+			name:   "json",
+			output: `[{"unit":"backup.service","load":"loaded","active":"failed","sub":"failed","description":"Nightly backup"},{"unit":"mnt-nas.mount","load":"loaded","active":"failed","sub":"failed","description":"/mnt/nas"}]` + "\n",
+			want:   []string{"backup.service", "mnt-nas.mount"},
+		},
+		{
+			name:   "json without failed units",
+			output: "[]\n",
+			want:   []string{},
+		},
+		{
+			// systemd before 246 ignores --output=json
+			name: "plain",
+			output: "● backup.service loaded failed failed Nightly backup\n" +
+				"● mnt-nas.mount  loaded failed failed /mnt/nas\n",
+			want: []string{"backup.service", "mnt-nas.mount"},
+		},
+		{
+			name:   "plain without failed units",
+			output: "",
+			want:   []string{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseFailedUnits(test.output)
+			if err != nil {
+				t.Fatalf("parseFailedUnits() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseFailedUnits() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseFailedUnitsInvalidJSON(t *testing.T) {
+	if _, err := parseFailedUnits(`[{"unit":`); err == nil {
+		t.Error("parseFailedUnits() accepted truncated JSON")
+	}
+}
+
+func TestUnitEntityKeys(t *testing.T) {
+	// systemctl show getty@tty1.service, as printed by systemd 252
+	units := parseSystemctlShow(`NRestarts=0
+Id=getty@tty1.service
+Description=Getty on tty1
+LoadState=loaded
+ActiveState=active
+SubState=running
+`)
+	device := NewDevice("Host", "Manufacturer", "Model", "host-sn")
+	components := collectedComponents(t, device, unitEntities("getty@tty1.service", units[0])...)
+
+	for key, name := range map[string]string{
+		"getty_tty_1_active_state": "getty@tty1 Active State",
+		"getty_tty_1_sub_state":    "getty@tty1 Sub State",
+		"getty_tty_1_restarts":     "getty@tty1 Restarts",
+	} {
+		sensor := device.GetSensorByName(name)
+		if sensor == nil {
+			t.Fatalf("no sensor named %q", name)
+		}
+		if sensor.Key() != key {
+			t.Errorf("key of %q = %q, want %q", name, sensor.Key(), key)
+		}
+		if component, ok := components[key]; !ok || component.ValueTemplate != "{{ value_json."+key+" }}" {
+			t.Errorf("component %q = %+v (found %v)", key, component, ok)
+		}
+	}
+}
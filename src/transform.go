@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DEFAULT_PRECISION is the number of decimals kept for numeric values when a
+// sensor does not configure its own precision.
+const DEFAULT_PRECISION = 2
+
+// unitConversions lists the named conversions available to the `convert` step.
+var unitConversions = map[string]func(float64) float64{
+	"millicelsius_to_celsius": func(v float64) float64 { return v / 1000 },
+	"celsius_to_fahrenheit":   func(v float64) float64 { return v*9/5 + 32 },
+	"fahrenheit_to_celsius":   func(v float64) float64 { return (v - 32) * 5 / 9 },
+	"bytes_to_kib":            func(v float64) float64 { return v / (1 << 10) },
+	"bytes_to_mib":            func(v float64) float64 { return v / (1 << 20) },
+	"bytes_to_gib":            func(v float64) float64 { return v / (1 << 30) },
+	"bytes_to_tib":            func(v float64) float64 { return v / (1 << 40) },
+	"kib_to_mib":              func(v float64) float64 { return v / (1 << 10) },
+	"kib_to_gib":              func(v float64) float64 { return v / (1 << 20) },
+	"bytes_to_kb":             func(v float64) float64 { return v / 1e3 },
+	"bytes_to_mb":             func(v float64) float64 { return v / 1e6 },
+	"bytes_to_gb":             func(v float64) float64 { return v / 1e9 },
+	"bits_to_bytes":           func(v float64) float64 { return v / 8 },
+	"bytes_to_bits":           func(v float64) float64 { return v * 8 },
+	"seconds_to_minutes":      func(v float64) float64 { return v / 60 },
+	"seconds_to_hours":        func(v float64) float64 { return v / 3600 },
+	"seconds_to_days":         func(v float64) float64 { return v / 86400 },
+}
+
+// transformFunc is a single compiled step of a Transform.
+type transformFunc func(value string) (string, error)
+
+// Transform is the compiled post-processing pipeline of a sensor.
+// Steps are applied in order on the trimmed command output.
+type Transform struct {
+	steps []transformFunc
+}
+
+// NewTransform compiles the given transform steps into a Transform.
+// It validates every step so that configuration mistakes are reported at startup.
+//
+// Parameters:
+//   - steps: The list of steps as declared in the configuration file.
+//
+// Returns:
+//   - *Transform: A pointer to the compiled pipeline.
+//   - error: An error if a step is empty, ambiguous or invalid.
+func NewTransform(steps []TransformStep) (*Transform, error) {
+	transform := &Transform{
+		steps: make([]transformFunc, 0, len(steps)),
+	}
+	for i, step := range steps {
+		fn, err := compileTransformStep(step)
+		if err != nil {
+			return nil, fmt.Errorf("transform step %d: %w", i+1, err)
+		}
+		transform.steps = append(transform.steps, fn)
+	}
+	return transform, nil
+}
+
+// Apply runs the raw value through every step of the pipeline.
+//
+// Parameters:
+//   - value: The raw output of the sensor command.
+//
+// Returns:
+//   - The transformed value.
+//   - An error if any of the steps fails.
+func (t *Transform) Apply(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	for _, step := range t.steps {
+		var err error
+		value, err = step(value)
+		if err != nil {
+			return "", err
+		}
+		value = strings.TrimSpace(value)
+	}
+	return value, nil
+}
+
+// RoundValue rounds a numeric value to the given number of decimals.
+func RoundValue(value float64, precision int) float64 {
+	factor := math.Pow(10, float64(precision))
+	return math.Round(value*factor) / factor
+}
+
+func compileTransformStep(step TransformStep) (transformFunc, error) {
+	var fns []transformFunc
+
+	if step.Regex != "" {
+		re, err := regexp.Compile(step.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex: %w", err)
+		}
+		fns = append(fns, func(value string) (string, error) {
+			match := re.FindStringSubmatch(value)
+			if match == nil {
+				return "", fmt.Errorf("regex %q does not match %q", step.Regex, value)
+			}
+			if len(match) > 1 {
+				return match[1], nil
+			}
+			return match[0], nil
+		})
+	}
+	if step.StripPrefix != "" {
+		fns = append(fns, func(value string) (string, error) {
+			return strings.TrimPrefix(value, step.StripPrefix), nil
+		})
+	}
+	if step.StripSuffix != "" {
+		fns = append(fns, func(value string) (string, error) {
+			return strings.TrimSuffix(value, step.StripSuffix), nil
+		})
+	}
+	if step.Multiply != nil {
+		factor := *step.Multiply
+		fns = append(fns, numericStep(func(v float64) float64 { return v * factor }))
+	}
+	if step.Offset != nil {
+		offset := *step.Offset
+		fns = append(fns, numericStep(func(v float64) float64 { return v + offset }))
+	}
+	if step.Convert != "" {
+		conversion, ok := unitConversions[step.Convert]
+		if !ok {
+			return nil, fmt.Errorf("unknown conversion %q", step.Convert)
+		}
+		fns = append(fns, numericStep(conversion))
+	}
+	if step.Clamp != nil {
+		bounds := *step.Clamp
+		if bounds.Min != nil && bounds.Max != nil && *bounds.Min > *bounds.Max {
+			return nil, fmt.Errorf("clamp min %v is greater than max %v", *bounds.Min, *bounds.Max)
+		}
+		fns = append(fns, numericStep(func(v float64) float64 {
+			if bounds.Min != nil {
+				v = math.Max(v, *bounds.Min)
+			}
+			if bounds.Max != nil {
+				v = math.Min(v, *bounds.Max)
+			}
+			return v
+		}))
+	}
+	if step.Map != nil {
+		table := step.Map
+		fns = append(fns, func(value string) (string, error) {
+			mapped, ok := table[value]
+			if !ok {
+				return "", fmt.Errorf("no mapping for value %q", value)
+			}
+			return mapped, nil
+		})
+	}
+
+	switch len(fns) {
+	case 0:
+		return nil, fmt.Errorf("empty step")
+	case 1:
+		return fns[0], nil
+	default:
+		return nil, fmt.Errorf("a step must contain exactly one operation, got %d", len(fns))
+	}
+}
+
+// numericStep wraps a float operation into a transformFunc that parses and
+// formats the value around it.
+func numericStep(op func(float64) float64) transformFunc {
+	return func(value string) (string, error) {
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", fmt.Errorf("value %q is not numeric: %w", value, err)
+		}
+		return strconv.FormatFloat(op(v), 'f', -1, 64), nil
+	}
+}
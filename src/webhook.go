@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	WEBHOOK_MODE_CYCLE  = "cycle"
+	WEBHOOK_MODE_SENSOR = "sensor"
+
+	// WEBHOOK_SIGNATURE_HEADER holds the HMAC-SHA256 of the body, as `sha256=<hex>`.
+	WEBHOOK_SIGNATURE_HEADER = "X-PenguinHomeLink-Signature"
+)
+
+// webhookReading represents a reading or an event in the data of the body template.
+type webhookReading struct {
+	Time        time.Time      `json:"time"`
+	Serial      string         `json:"serial"`
+	Device      string         `json:"device"`
+	Sensor      string         `json:"sensor"`
+	Key         string         `json:"key"`
+	Value       any            `json:"value,omitempty"`
+	Error       string         `json:"error,omitempty"`
+	Unit        string         `json:"unit,omitempty"`
+	DeviceClass string         `json:"device_class,omitempty"`
+	Attributes  map[string]any `json:"attributes,omitempty"`
+	Event       map[string]any `json:"event,omitempty"`
+}
+
+// webhookCycle represents the data of the body template in the cycle mode.
+type webhookCycle struct {
+	Time     time.Time        `json:"time"`
+	Readings []webhookReading `json:"readings"`
+	Events   []webhookReading `json:"events,omitempty"`
+}
+
+// webhookDelivery represents a failed delivery, kept in the dead-letter file.
+type webhookDelivery struct {
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	URL    string    `json:"url"`
+	Body   string    `json:"body"`
+	Error  string    `json:"error"`
+}
+
+// lastWebhookReading represents the last reading of a sensor delivered in the sensor mode.
+type lastWebhookReading struct {
+	value any
+	err   string
+}
+
+// WebhookSink is a Sink sending the readings to an HTTP endpoint, such as an n8n or
+// Node-RED workflow. The body is rendered from a template, once per refresh in the
+// cycle mode, or once per sensor whose reading changed and per event in the sensor
+// mode. The body is signed when a secret is set. The deliveries failing after their
+// retries are appended to the dead-letter file.
+//
+// Fields:
+// - url: The URL of the webhook.
+// - method: The HTTP method of the requests.
+// - headers: The headers added to the requests.
+// - body: The template of the body, or nil to send the data as JSON.
+// - mode: The mode of the sink, WEBHOOK_MODE_CYCLE or WEBHOOK_MODE_SENSOR.
+// - secret: The secret of the signature, or empty to not sign the body.
+// - deadLetter: The dead-letter file, or empty to drop the failed deliveries.
+// - timeout: The time the endpoint is given to answer.
+// - retries: The number of times a failed delivery is retried.
+// - last: The last reading delivered for every sensor, in the sensor mode.
+type WebhookSink struct {
+	url        string
+	method     string
+	headers    map[string]string
+	body       *template.Template
+	mode       string
+	secret     string
+	deadLetter string
+	timeout    time.Duration
+	retries    int
+	last       map[*Sensor]lastWebhookReading
+}
+
+// NewWebhookSink creates a new webhook sink from its configuration file entry.
+//
+// Parameters:
+//   - cfg: The sink entry of the configuration file.
+//
+// Returns:
+//   - A pointer to the newly created WebhookSink instance.
+//   - An error if the configuration is invalid.
+func NewWebhookSink(cfg SinkConfig) (*WebhookSink, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("webhook sink: url is required")
+	}
+	if cfg.TimeoutS < 0 || cfg.Retries != nil && *cfg.Retries < 0 {
+		return nil, fmt.Errorf("webhook sink %q: timeout and retries must not be negative", cfg.URL)
+	}
+	sink := &WebhookSink{
+		url:        cfg.URL,
+		method:     strings.ToUpper(cfg.Method),
+		headers:    cfg.Headers,
+		mode:       cfg.Mode,
+		secret:     cfg.Secret,
+		deadLetter: cfg.DeadLetter,
+		timeout:    DEFAULT_SINK_TIMEOUT,
+		retries:    DEFAULT_SINK_RETRIES,
+		last:       map[*Sensor]lastWebhookReading{},
+	}
+	if sink.method == "" {
+		sink.method = http.MethodPost
+	}
+	if sink.mode == "" {
+		sink.mode = WEBHOOK_MODE_CYCLE
+	}
+	if sink.mode != WEBHOOK_MODE_CYCLE && sink.mode != WEBHOOK_MODE_SENSOR {
+		return nil, fmt.Errorf("webhook sink %q: unknown mode %q", cfg.URL, cfg.Mode)
+	}
+	if cfg.TimeoutS > 0 {
+		sink.timeout = time.Duration(cfg.TimeoutS) * time.Second
+	}
+	if cfg.Retries != nil {
+		sink.retries = *cfg.Retries
+	}
+	if cfg.Body != "" {
+		body, err := template.New("body").Option("missingkey=error").Funcs(template.FuncMap{
+			"json": func(value any) (string, error) {
+				data, err := json.Marshal(value)
+				return string(data), err
+			},
+		}).Parse(cfg.Body)
+		if err != nil {
+			return nil, fmt.Errorf("webhook sink %q: %w", cfg.URL, err)
+		}
+		sink.body = body
+	}
+	return sink, nil
+}
+
+// Name returns the name of the sink, which includes the URL of the webhook.
+func (s *WebhookSink) Name() string {
+	return "webhook:" + s.url
+}
+
+// Publish delivers the readings and the events of the snapshot according to the
+// mode of the sink. In the sensor mode, every delivery is attempted even when
+// another one failed.
+func (s *WebhookSink) Publish(ctx context.Context, device *Device, snapshot *Snapshot) error {
+	var readings []webhookReading
+	var sensors []*Sensor
+	current := map[*Sensor]bool{}
+	for _, dev := range device.Devices() {
+		snapshotReadings := snapshot.Of(dev).Readings
+		for _, sensor := range dev.GetSensors() {
+			current[sensor] = true
+			reading, ok := snapshotReadings[sensor.Key()]
+			if !ok || errors.Is(reading.Err, ErrNoValue) {
+				continue
+			}
+			data := newWebhookReading(dev, sensor, reading.Time, snapshot.Time)
+			data.Attributes = reading.Attributes
+			if reading.Err != nil {
+				data.Error = reading.Err.Error()
+			} else {
+				data.Value = reading.Value
+			}
+
+			// Only the sensors whose reading changed are delivered in the sensor mode
+			if s.mode == WEBHOOK_MODE_SENSOR {
+				last, ok := s.last[sensor]
+				if ok && last.err == data.Error && reflect.DeepEqual(last.value, data.Value) {
+					continue
+				}
+			}
+			readings = append(readings, data)
+			sensors = append(sensors, sensor)
+		}
+	}
+	// Forget the sensors removed by the collectors
+	for sensor := range s.last {
+		if !current[sensor] {
+			delete(s.last, sensor)
+		}
+	}
+	var events []webhookReading
+	for _, event := range snapshot.Events {
+		data := newWebhookReading(event.sensor.Device, event.sensor, time.Time{}, snapshot.Time)
+		data.Event = event.payload
+		events = append(events, data)
+	}
+
+	if s.mode == WEBHOOK_MODE_CYCLE {
+		if len(readings) == 0 && len(events) == 0 {
+			return nil
+		}
+		return s.deliver(ctx, webhookCycle{Time: snapshot.Time, Readings: readings, Events: events})
+	}
+	// A reading is only recorded once delivered, or kept in the dead-letter file,
+	// so that a failed delivery is retried with the next publication
+	var errs []error
+	for i, data := range readings {
+		if err := s.deliver(ctx, data); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", data.Key, err))
+			if s.deadLetter == "" {
+				continue
+			}
+		}
+		s.last[sensors[i]] = lastWebhookReading{value: data.Value, err: data.Error}
+	}
+	for _, data := range events {
+		if err := s.deliver(ctx, data); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", data.Key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// newWebhookReading returns the data of a sensor of a device, taken at the given
+// time or, when it is unknown, at the time of the snapshot.
+func newWebhookReading(device *Device, sensor *Sensor, at time.Time, fallback time.Time) webhookReading {
+	if at.IsZero() {
+		at = fallback
+	}
+	return webhookReading{
+		Time:        at,
+		Serial:      device.GetDeviceInfo().SerialNumber,
+		Device:      device.GetDeviceInfo().Name,
+		Sensor:      sensor.config.Name,
+		Key:         sensor.Key(),
+		Unit:        sensor.config.UnitOfMeasurement,
+		DeviceClass: sensor.config.DeviceClass,
+	}
+}
+
+// deliver renders the body of the data and sends it, with its retries. A failed
+// delivery is kept in the dead-letter file.
+func (s *WebhookSink) deliver(ctx context.Context, data any) error {
+	var body bytes.Buffer
+	if s.body == nil {
+		if err := json.NewEncoder(&body).Encode(data); err != nil {
+			return err
+		}
+	} else if err := s.body.Execute(&body, data); err != nil {
+		return fmt.Errorf("rendering of the body failed: %w", err)
+	}
+
+	err := withRetry(ctx, s.retries, func() error {
+		return s.send(ctx, body.Bytes())
+	})
+	if err != nil && s.deadLetter != "" {
+		if deadLetterErr := s.keepDeadLetter(body.String(), err); deadLetterErr != nil {
+			return errors.Join(err, deadLetterErr)
+		}
+	}
+	return err
+}
+
+// send sends a request to the webhook.
+func (s *WebhookSink) send(ctx context.Context, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, s.method, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if s.body == nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for name, value := range s.headers {
+		req.Header.Set(name, value)
+	}
+	if s.secret != "" {
+		mac := hmac.New(sha256.New, []byte(s.secret))
+		mac.Write(body)
+		req.Header.Set(WEBHOOK_SIGNATURE_HEADER, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return newHTTPStatusError("delivery", resp)
+	}
+	return nil
+}
+
+// keepDeadLetter appends a failed delivery to the dead-letter file.
+func (s *WebhookSink) keepDeadLetter(body string, deliveryErr error) error {
+	line, err := json.Marshal(webhookDelivery{
+		Time:   time.Now(),
+		Method: s.method,
+		URL:    s.url,
+		Body:   body,
+		Error:  deliveryErr.Error(),
+	})
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.deadLetter, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(line, '\n'))
+	return err
+}